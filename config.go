@@ -13,6 +13,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"regexp"
 	"strings"
@@ -32,12 +33,16 @@ type ConfigFunc func(*Interactor, []string) error
 // user. If you are a plugin, you can add to it via your init function. You can
 // pass closures, of course, or a method pointer. Any error returned is fatal
 // and we stop processing and shut down.
-var ConfigMap map[string]ConfigFunc = map[string]ConfigFunc{
-	`^CREATE\s+SERVICE\s+(\w+)$`:       cfg_CreateService,
-	`^CREATE\s+POOL\s+(\w+)$`:          cfg_CreatePool,
-	`^SET\s+(\w+\.)?(\w+)\s*=\s*(.+)$`: cfg_Set,
-	`^ENABLE\s+(\w+)$`:                 cfg_Enable,
-	`^DEFAULT\s+(\w+)\s*=\s*(.+)$`:     cfg_Default,
+var ConfigMap map[string]ConfigFunc = make(map[string]ConfigFunc)
+
+// The built-in items are registered the same way a plugin would. This has to
+// happen in init as the management port refers back to ConfigMap.
+func init() {
+	ConfigMap[`^CREATE\s+SERVICE\s+(\w+)$`] = cfg_CreateService
+	ConfigMap[`^CREATE\s+POOL\s+(\w+)$`] = cfg_CreatePool
+	ConfigMap[`^SET\s+(?:(\w+)\.)?([\w.]+)\s*=\s*(.+)$`] = cfg_Set
+	ConfigMap[`^ENABLE\s+(\w+)$`] = cfg_Enable
+	ConfigMap[`^DEFAULT\s+(\w+)\s*=\s*(.+)$`] = cfg_Default
 }
 
 // cfg_Default sets a default. These apply to newly created services.
@@ -47,27 +52,34 @@ func cfg_Default(cur *Interactor, m []string) error {
 }
 
 // cfg_Set sets a variable on something. We assume that anything that can be
-// set obeys the Interactor interface.
+// set obeys the Interactor interface. Keys can have dots in them, for plugin
+// settings, so if the first part isn't the name of a service or pool it's
+// taken to be part of the key.
 func cfg_Set(cur *Interactor, m []string) error {
-	if m[1] == "" {
-		// Not specified, use current.
-		if cur == nil {
-			return errors.New("attempt to set, but no service defined")
+	if m[1] != "" {
+		// Specified, load specific service or pool.
+		if svc, ok := GetService(m[1]); ok {
+			return svc.Set(m[2], m[3])
 		}
-		return (*cur).Set(m[2], m[3])
+		if pool, ok := pools[m[1]]; ok {
+			return pool.Set(m[2], m[3])
+		}
+		if cur == nil || *cur == nil {
+			return errors.New(fmt.Sprintf("service '%s' not found", m[1]))
+		}
+		m[2] = m[1] + "." + m[2]
 	}
 
-	// Specified, load specific service.
-	mcur, ok := services[m[1]]
-	if !ok {
-		return errors.New(fmt.Sprintf("service '%s' not found", m[1]))
+	// Not specified, use current.
+	if cur == nil || *cur == nil {
+		return errors.New("attempt to set, but no service defined")
 	}
-	return mcur.Set(m[2], m[3])
+	return (*cur).Set(m[2], m[3])
 }
 
 // cfg_Enable finishes the configuration of an object and starts it up.
 func cfg_Enable(cur *Interactor, m []string) error {
-	mcur, ok := services[m[1]]
+	mcur, ok := GetService(m[1])
 	if !ok {
 		return errors.New(fmt.Sprintf("service '%s' not found", m[1]))
 	}
@@ -131,29 +143,107 @@ func loadConfig(file string) error {
 			continue
 		}
 
-		// Now iterate over our config map. This is very slow, but we're talking
-		// small numbers of N and is just a startup cost, so it shouldn't matter
-		// much at the end of the day.
-		any := false
-		for str, fnc := range ConfigMap {
-			re, err := regexp.Compile("(?i:" + str + ")")
-			if err != nil {
-				return err
-			}
+		if err := runConfigLine(&current, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runConfigLine finds the handler in ConfigMap for a single line and runs it.
+// This is shared by the configuration file loader and the management port.
+func runConfigLine(cur *Interactor, line string) error {
+	// Now iterate over our config map. This is very slow, but we're talking
+	// small numbers of N and is just a startup cost, so it shouldn't matter
+	// much at the end of the day.
+	for str, fnc := range ConfigMap {
+		re, err := regexp.Compile("(?i:" + str + ")")
+		if err != nil {
+			return err
+		}
+
+		m := re.FindStringSubmatch(line)
+		if m != nil {
+			return fnc(cur, m)
+		}
+	}
+	return errors.New(fmt.Sprintf("invalid config: %s", line))
+}
 
-			m := re.FindStringSubmatch(line)
-			if m != nil {
-				err = fnc(&current, m)
-				if err != nil {
-					return err
-				}
-				any = true
-				break
+// ParseBool understands the various ways people write booleans in their
+// configuration files.
+func ParseBool(value string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "1", "on", "yes", "true":
+		return true, nil
+	case "0", "off", "no", "false":
+		return false, nil
+	}
+	return false, errors.New(fmt.Sprintf("invalid boolean '%s'", value))
+}
+
+// SplitList breaks up a comma separated configuration value, dropping any
+// whitespace around the items.
+func SplitList(value string) []string {
+	var out []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// IPList is a list of networks from the configuration, such as the proxies
+// that we trust.
+type IPList []*net.IPNet
+
+// ParseIPList reads a comma separated list of CIDRs. Plain addresses are
+// allowed and are taken to mean just that address.
+func ParseIPList(value string) (IPList, error) {
+	var list IPList
+	for _, item := range SplitList(value) {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, errors.New(fmt.Sprintf("invalid address '%s'", item))
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
 			}
+			list = append(list, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
 		}
-		if !any {
-			return errors.New(fmt.Sprintf("invalid config: %s", line))
+
+		_, ipnet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
 		}
+		list = append(list, ipnet)
 	}
-	return nil
+	return list, nil
+}
+
+// Contains returns true if the address is in any of our networks. Addresses
+// that aren't IP based never match.
+func (l IPList) Contains(addr net.Addr) bool {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.IPAddr:
+		ip = a.IP
+	default:
+		return false
+	}
+	for _, ipnet := range l {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
@@ -11,8 +11,11 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"net"
+	"strings"
 	"time"
 )
 
@@ -49,6 +52,45 @@ func MakeTcpConnection(ipport string) (*TcpConnection, error) {
 	return WrapTcpConnection(conn)
 }
 
+// MakeTlsConnection is like MakeTcpConnection, but also does a TLS handshake
+// with the other end before handing back the connection.
+func MakeTlsConnection(ipport string, cfg *tls.Config) (*TcpConnection, error) {
+	conn, err := net.DialTimeout("tcp", ipport, 3*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	tconn, err := StartTls(conn, ipport, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return WrapTcpConnection(tconn)
+}
+
+// StartTls does the client side of a TLS handshake on a connection we made to
+// ipport. If the config does not name a server, we use the host we connected
+// to. The connection is closed if the handshake fails.
+func StartTls(conn net.Conn, ipport string, cfg *tls.Config) (*tls.Conn, error) {
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(ipport)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		cfg = cfg.Clone()
+		cfg.ServerName = host
+	}
+
+	tconn := tls.Client(conn, cfg)
+	tconn.SetDeadline(time.Now().Add(3 * time.Second))
+	if err := tconn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tconn.SetDeadline(time.Time{})
+	return tconn, nil
+}
+
 // WrapTcpConnection takes a bare net.TCPConn and wraps it up in a TcpConnection
 // after constructing some readers and writers for us to use.
 func WrapTcpConnection(conn net.Conn) (*TcpConnection, error) {
@@ -67,14 +109,28 @@ func WrapTcpConnection(conn net.Conn) (*TcpConnection, error) {
 func (c *TcpConnection) pump() {
 	defer c.Close()
 
+	var current Interactor
 	for {
 		ln, err := c.ReadLine()
 		if err != nil {
 			return
 		}
 
+		ln = strings.TrimSpace(ln)
+		if ln == "" {
+			continue
+		}
+
 		// Handle an administration command of some sort.
 		log.Debug("received: %s", ln)
+		if err := runManageLine(c, &current, ln); err != nil {
+			c.WriteLine(fmt.Sprintf("ERROR: %s", err))
+		} else {
+			c.WriteLine("OK")
+		}
+		if err := c.BWriter.Flush(); err != nil {
+			return
+		}
 	}
 }
 
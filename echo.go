@@ -0,0 +1,138 @@
+/*
+	gobal - echo.go
+
+	The echo role. Requests are answered with what we received: the request
+	line, the headers and the body. This is for testing what makes it through
+	gobal and whatever is in front of it, and with echo_delay, for seeing how
+	clients cope with slow responses.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MAX_ECHO_BODY is the most of a request body we'll send back.
+const MAX_ECHO_BODY = 1024 * 1024
+
+// echoPlugin is here so that Perlbal configurations work. Perlbal needs the
+// EchoService plugin for the echo role, but we always have it.
+type echoPlugin struct {
+	BasePlugin
+}
+
+// echoReply is what we send back when JSON is asked for.
+type echoReply struct {
+	Method     string              `json:"method"`
+	URI        string              `json:"uri"`
+	Proto      string              `json:"proto"`
+	Host       string              `json:"host"`
+	RemoteAddr string              `json:"remote_addr"`
+	Headers    map[string][]string `json:"headers"`
+	Body       string              `json:"body"`
+}
+
+func init() {
+	RegisterPlugin(echoPlugin{})
+}
+
+func (p echoPlugin) Name() string {
+	return "EchoService"
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// Echoing requests
+//////////////////////////////////////////////////////////////////////////////
+
+// echoRequest answers a request with itself, after waiting for echo_delay.
+// JSON is sent if the service is set up for it or the client asks for it.
+func (s *Service) echoRequest(req ServiceRequest) {
+	body, err := ioutil.ReadAll(io.LimitReader(req.request.Body,
+		MAX_ECHO_BODY+1))
+	if err != nil {
+		s.respond(req, HttpErrorResponse(req.request, err))
+		return
+	}
+	if len(body) > MAX_ECHO_BODY {
+		s.respond(req, HttpSimpleResponse(req.request, 413,
+			fmt.Sprintf("Body too large, limit is %d bytes", MAX_ECHO_BODY)))
+		return
+	}
+
+	if s.EchoDelay > 0 {
+		time.Sleep(s.EchoDelay)
+	}
+
+	var out []byte
+	ctype := "text/plain; charset=utf-8"
+	if s.EchoJson ||
+		strings.Contains(req.request.Header.Get("Accept"), "application/json") {
+		out, err = echoJson(req, body)
+		ctype = "application/json"
+	} else {
+		out = echoText(req.request, body)
+	}
+	if err != nil {
+		s.respond(req, HttpErrorResponse(req.request, err))
+		return
+	}
+
+	resp := HttpSimpleResponse(req.request, 200, string(out))
+	resp.Header.Set("Content-Type", ctype)
+	s.respond(req, resp)
+}
+
+// echoText writes the request out much as it came in, with the headers in
+// order so that it's easy to compare.
+func echoText(req *http.Request, body []byte) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s %s\r\n", req.Method, req.RequestURI, req.Proto)
+	if req.Host != "" {
+		fmt.Fprintf(&buf, "Host: %s\r\n", req.Host)
+	}
+
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range req.Header[name] {
+			fmt.Fprintf(&buf, "%s: %s\r\n", name, value)
+		}
+	}
+
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+// echoJson describes the request as a JSON object.
+func echoJson(req ServiceRequest, body []byte) ([]byte, error) {
+	reply := echoReply{
+		Method:     req.request.Method,
+		URI:        req.request.RequestURI,
+		Proto:      req.request.Proto,
+		Host:       req.request.Host,
+		RemoteAddr: req.client.RemoteAddr().String(),
+		Headers:    req.request.Header,
+		Body:       string(body),
+	}
+	out, err := json.MarshalIndent(reply, "", "  ")
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("echo: %s", err))
+	}
+	return append(out, '\n'), nil
+}
@@ -0,0 +1,79 @@
+/*
+	gobal - echo_test.go
+
+	Tests for the echo role.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// echoTestRequest parses a request the way it would come off the wire.
+func echoTestRequest(t *testing.T, raw string) *http.Request {
+	req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestEchoText(t *testing.T) {
+	req := echoTestRequest(t, "POST /a?b=c HTTP/1.1\r\n"+
+		"Host: site.com\r\n"+
+		"X-Zed: 1\r\n"+
+		"Accept: */*\r\n"+
+		"X-Zed: 2\r\n"+
+		"\r\n")
+
+	// Headers come out sorted, repeats in the order they came.
+	want := "POST /a?b=c HTTP/1.1\r\n" +
+		"Host: site.com\r\n" +
+		"Accept: */*\r\n" +
+		"X-Zed: 1\r\n" +
+		"X-Zed: 2\r\n" +
+		"\r\n" +
+		"hello"
+	if got := string(echoText(req, []byte("hello"))); got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestEchoRequest(t *testing.T) {
+	s := &Service{Name: "test", Stats: NewServiceStats()}
+	client, _ := net.Pipe()
+	echo := func(raw string) *http.Response {
+		req := ServiceRequest{client: client, request: echoTestRequest(t, raw),
+			rchan: make(chan *http.Response, 1)}
+		s.echoRequest(req)
+		return <-req.rchan
+	}
+
+	resp := echo("PUT /x HTTP/1.1\r\nHost: site.com\r\n" +
+		"Accept: application/json\r\nContent-Length: 5\r\n\r\nhello")
+	var reply echoReply
+	data, _ := ioutil.ReadAll(resp.Body)
+	if err := json.Unmarshal(data, &reply); err != nil {
+		t.Fatalf("%s: %q", err, data)
+	}
+	if resp.Header.Get("Content-Type") != "application/json" ||
+		reply.Method != "PUT" || reply.URI != "/x" || reply.Host != "site.com" ||
+		reply.RemoteAddr != "pipe" || reply.Body != "hello" {
+		t.Errorf("got %s", data)
+	}
+
+	resp = echo("GET / HTTP/1.1\r\nHost: site.com\r\n\r\n")
+	data, _ = ioutil.ReadAll(resp.Body)
+	if !strings.HasPrefix(string(data), "GET / HTTP/1.1\r\n") {
+		t.Errorf("got %q", data)
+	}
+}
@@ -0,0 +1,215 @@
+/*
+	gobal - filecache.go
+
+	Open files for the web server role. Hot files are kept open between
+	requests, so we don't have to open and stat them every time. Several
+	requests can be sending the same file at once, so nothing may rely on
+	its offset; read it with ReadAt or sendfile with an explicit offset.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// FD_CACHE_CHECK is how long we trust a cached file before checking that it
+// hasn't been changed or replaced on disk.
+const FD_CACHE_CHECK = time.Second
+
+// FileCache keeps up to max files open, dropping the least recently used when
+// it's full. A cache with a max of zero opens every file fresh.
+type FileCache struct {
+	lock    sync.Mutex
+	max     int
+	entries map[string]*CachedFile
+}
+
+// CachedFile is an open file and what it looked like when we opened it. It's
+// closed once it's out of the cache and nobody is using it.
+type CachedFile struct {
+	File *os.File
+	Info os.FileInfo
+
+	path    string
+	checked time.Time
+	used    time.Time
+	refs    int
+	cached  bool
+}
+
+// fileBody is the body of a response that's read from a file, which is given
+// back to the cache when the client is done with it. If the body is a single
+// part of the file, we know where and can send it with sendfile.
+type fileBody struct {
+	io.Reader
+	file   *CachedFile
+	cache  *FileCache
+	offset int64
+	length int64
+	closed bool
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// FileCache implementation
+//////////////////////////////////////////////////////////////////////////////
+
+// NewFileCache makes a cache that keeps up to max files open.
+func NewFileCache(max int) *FileCache {
+	return &FileCache{
+		max:     max,
+		entries: make(map[string]*CachedFile),
+	}
+}
+
+// Open returns an open file, from the cache if we have it. Call Release when
+// done with it.
+func (c *FileCache) Open(path string) (*CachedFile, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	if cf, ok := c.entries[path]; ok {
+		if now.Sub(cf.checked) < FD_CACHE_CHECK || cf.unchanged() {
+			cf.checked, cf.used = now, now
+			cf.refs++
+			return cf, nil
+		}
+		c.drop(cf)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	cf := &CachedFile{
+		File:    f,
+		Info:    fi,
+		path:    path,
+		checked: now,
+		used:    now,
+		refs:    1,
+	}
+	if c.max > 0 && !fi.IsDir() {
+		if len(c.entries) >= c.max {
+			c.evict()
+		}
+		cf.cached = true
+		c.entries[path] = cf
+	}
+	return cf, nil
+}
+
+// Release says we're done with a file from Open.
+func (c *FileCache) Release(cf *CachedFile) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	cf.refs--
+	if cf.refs == 0 && !cf.cached {
+		cf.File.Close()
+	}
+}
+
+// Forget drops a file from the cache, for when we've changed it ourselves and
+// can't wait for it to be noticed.
+func (c *FileCache) Forget(path string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if cf, ok := c.entries[path]; ok {
+		c.drop(cf)
+	}
+}
+
+// Close drops everything from the cache. Files that are in use stay open
+// until they're released.
+func (c *FileCache) Close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, cf := range c.entries {
+		c.drop(cf)
+	}
+}
+
+// evict drops the least recently used file to make room for another.
+func (c *FileCache) evict() {
+	var oldest *CachedFile
+	for _, cf := range c.entries {
+		if oldest == nil || cf.used.Before(oldest.used) {
+			oldest = cf
+		}
+	}
+	if oldest != nil {
+		c.drop(oldest)
+	}
+}
+
+// drop takes a file out of the cache, closing it unless it's in use. The
+// lock must be held.
+func (c *FileCache) drop(cf *CachedFile) {
+	delete(c.entries, cf.path)
+	cf.cached = false
+	if cf.refs == 0 {
+		cf.File.Close()
+	}
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// fileBody implementation
+//////////////////////////////////////////////////////////////////////////////
+
+// SendTo writes the body to a connection. Where we can, the data goes
+// straight from the file to the socket, otherwise it's copied.
+func (b *fileBody) SendTo(conn net.Conn) (int64, error) {
+	if tconn := tcpConnOf(conn); tconn != nil && b.length >= 0 {
+		return sendfile(tconn, b.file.File, b.offset, b.length)
+	}
+	return io.Copy(conn, b.Reader)
+}
+
+func (b *fileBody) Close() error {
+	if !b.closed {
+		b.closed = true
+		b.cache.Release(b.file)
+	}
+	return nil
+}
+
+// tcpConnOf finds the TCP connection under a client connection, if there's
+// nothing like TLS in between.
+func tcpConnOf(conn net.Conn) *net.TCPConn {
+	switch c := conn.(type) {
+	case *net.TCPConn:
+		return c
+	case *bufferedConn:
+		return tcpConnOf(c.Conn)
+	case *proxiedConn:
+		return tcpConnOf(c.Conn)
+	}
+	return nil
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// CachedFile implementation
+//////////////////////////////////////////////////////////////////////////////
+
+// unchanged returns true if the file on disk is still the one we have open.
+func (cf *CachedFile) unchanged() bool {
+	fi, err := os.Stat(cf.path)
+	return err == nil && os.SameFile(fi, cf.Info) &&
+		fi.Size() == cf.Info.Size() && fi.ModTime().Equal(cf.Info.ModTime())
+}
@@ -0,0 +1,166 @@
+/*
+	gobal - filecache_test.go
+
+	Tests for keeping files open between requests.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// isOpen returns true if a file hasn't been closed.
+func isOpen(cf *CachedFile) bool {
+	_, err := cf.File.Stat()
+	return err == nil
+}
+
+func TestFileCacheRefs(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gobal-files-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	for _, name := range []string{"a", "b", "c"} {
+		writeFile(t, tmp+"/"+name, []byte(name))
+	}
+	open := func(c *FileCache, name string) *CachedFile {
+		cf, err := c.Open(tmp + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cf
+	}
+
+	// Hot files are shared, and stay open when nobody is using them.
+	c := NewFileCache(2)
+	a := open(c, "a")
+	if again := open(c, "a"); again != a {
+		t.Errorf("opened a twice")
+	}
+	c.Release(a)
+	c.Release(a)
+	if !isOpen(a) {
+		t.Errorf("a was closed while cached")
+	}
+
+	// Forgetting a file in use leaves it open until it's released, and the
+	// next Open gets a new one.
+	a = open(c, "a")
+	c.Forget(tmp + "/a")
+	if !isOpen(a) {
+		t.Errorf("a was closed while in use")
+	}
+	if again := open(c, "a"); again == a {
+		t.Errorf("got a forgotten file back")
+	} else {
+		c.Release(again)
+	}
+	c.Release(a)
+	if isOpen(a) {
+		t.Errorf("a was left open once forgotten and released")
+	}
+
+	// Making room works the same way, and takes the least recently used.
+	a = open(c, "a")
+	time.Sleep(time.Millisecond)
+	b := open(c, "b")
+	c.Release(b)
+	cc := open(c, "c")
+	if !isOpen(a) || !isOpen(b) {
+		t.Errorf("evicted a file too soon")
+	}
+	if _, ok := c.entries[tmp+"/a"]; ok {
+		t.Errorf("a wasn't evicted")
+	}
+	c.Release(a)
+	if isOpen(a) {
+		t.Errorf("a was left open once evicted and released")
+	}
+
+	// Closing the cache closes what isn't in use.
+	c.Close()
+	if isOpen(b) || !isOpen(cc) {
+		t.Errorf("closing: b open %v, c open %v", isOpen(b), isOpen(cc))
+	}
+	c.Release(cc)
+	if isOpen(cc) {
+		t.Errorf("c was left open after closing")
+	}
+
+	// Without a cache, every file is its own.
+	c = NewFileCache(0)
+	a = open(c, "a")
+	if again := open(c, "a"); again == a {
+		t.Errorf("shared a file without a cache")
+	} else {
+		c.Release(again)
+	}
+	c.Release(a)
+	if isOpen(a) {
+		t.Errorf("a was left open without a cache")
+	}
+}
+
+func TestFileCacheStale(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gobal-files-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	file := tmp + "/a"
+	writeFile(t, file, []byte("first"))
+
+	c := NewFileCache(10)
+	reopen := func(cf *CachedFile) *CachedFile {
+		c.Release(cf)
+		cf, err := c.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cf
+	}
+	cf, err := c.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes aren't looked for until it's been a while, and then only a
+	// change counts.
+	writeFile(t, file, []byte("second!"))
+	if got := reopen(cf); got != cf {
+		t.Errorf("checked too soon")
+	}
+	cf.checked = cf.checked.Add(-FD_CACHE_CHECK)
+	got := reopen(cf)
+	if got == cf || got.Info.Size() != 7 {
+		t.Errorf("missed a change in size")
+	}
+	got.checked = got.checked.Add(-FD_CACHE_CHECK)
+	if again := reopen(got); again != got {
+		t.Errorf("reopened an unchanged file")
+	}
+
+	// Replacing the file is a change, even if it looks the same.
+	cf = got
+	info := cf.Info
+	if err := os.Rename(file, tmp+"/old"); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, file, []byte("second!"))
+	if err := os.Chtimes(file, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	cf.checked = cf.checked.Add(-FD_CACHE_CHECK)
+	if got := reopen(cf); got == cf {
+		t.Errorf("missed the file being replaced")
+	} else {
+		c.Release(got)
+	}
+}
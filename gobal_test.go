@@ -0,0 +1,18 @@
+/*
+	gobal - gobal_test.go
+
+	Setup shared by the tests.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	logging "github.com/fluffle/golog/logging"
+)
+
+func init() {
+	// Plenty of what we test logs as it goes, and main isn't run.
+	log = logging.InitFromFlags()
+}
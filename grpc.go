@@ -0,0 +1,157 @@
+/*
+	gobal - grpc.go
+
+	Helpers for proxying gRPC. Calls are just HTTP/2 requests, but the status
+	of the call is carried in the trailers, and errors have to be given back
+	in a form that gRPC clients understand.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gRPC status codes that we generate ourselves.
+const (
+	GRPC_OK          = 0
+	GRPC_UNKNOWN     = 2
+	GRPC_INTERNAL    = 13
+	GRPC_UNAVAILABLE = 14
+)
+
+// GRPC_HEALTH_SERVING is the status a healthy backend reports from the
+// standard grpc.health.v1.Health service.
+const GRPC_HEALTH_SERVING = 1
+
+// IsGrpcRequest returns true if the request is a gRPC call. gRPC-Web is not
+// included, as it carries its status in the body and proxies like plain HTTP.
+func IsGrpcRequest(req *http.Request) bool {
+	ctype := req.Header.Get("Content-Type")
+	return strings.HasPrefix(ctype, "application/grpc") &&
+		!strings.HasPrefix(ctype, "application/grpc-web")
+}
+
+// GrpcStatus returns the grpc-status of a response, or an empty string if it
+// doesn't have one. The status is normally in the trailers, so those are only
+// there once the body has been read. Errors can come back in the headers.
+func GrpcStatus(resp *http.Response) string {
+	if status := resp.Trailer.Get("Grpc-Status"); status != "" {
+		return status
+	}
+	return resp.Header.Get("Grpc-Status")
+}
+
+// GrpcErrorResponse builds a "trailers-only" response, which is how a gRPC
+// server reports that a call failed before it sent anything.
+func GrpcErrorResponse(req *http.Request, code int, msg string) *http.Response {
+	resp := HttpSimpleResponse(req, 200, "")
+	resp.Header.Set("Content-Type", "application/grpc")
+	resp.Header.Set("Grpc-Status", strconv.Itoa(code))
+	resp.Header.Set("Grpc-Message", grpcEncodeMessage(msg))
+	return resp
+}
+
+// ProxyErrorResponse is what we send when we couldn't get a response from a
+// backend. gRPC clients are told the service is unavailable so they can retry.
+func ProxyErrorResponse(req *http.Request, err error) *http.Response {
+	if IsGrpcRequest(req) {
+		return GrpcErrorResponse(req, GRPC_UNAVAILABLE, err.Error())
+	}
+	return HttpErrorResponse(req, err)
+}
+
+// grpcEncodeMessage percent encodes a grpc-message as the spec requires.
+func grpcEncodeMessage(msg string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		} else {
+			buf.WriteByte(c)
+		}
+	}
+	return buf.String()
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// gRPC health checking
+//////////////////////////////////////////////////////////////////////////////
+
+// GrpcHealthRequest builds a call to grpc.health.v1.Health/Check on a backend.
+// An empty service asks about the server as a whole.
+func GrpcHealthRequest(ipport, service string) (*http.Request, error) {
+	// HealthCheckRequest only has the service name, as field 1.
+	var msg bytes.Buffer
+	if service != "" {
+		msg.WriteByte(0x0a)
+		msg.Write(binary.AppendUvarint(nil, uint64(len(service))))
+		msg.WriteString(service)
+	}
+
+	// Messages go over the wire behind a compressed flag and a length.
+	var body bytes.Buffer
+	body.WriteByte(0)
+	binary.Write(&body, binary.BigEndian, uint32(msg.Len()))
+	body.Write(msg.Bytes())
+
+	req, err := http.NewRequest("POST",
+		"http://"+ipport+"/grpc.health.v1.Health/Check", &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	return req, nil
+}
+
+// CheckGrpcHealth reads the response to a GrpcHealthRequest. Anything other
+// than a successful call saying the backend is serving is an error.
+func CheckGrpcHealth(resp *http.Response) error {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if status := GrpcStatus(resp); status != strconv.Itoa(GRPC_OK) {
+		return errors.New(fmt.Sprintf("health check failed: grpc-status %s: %s",
+			status, resp.Trailer.Get("Grpc-Message")))
+	}
+	if len(body) < 5 || body[0] != 0 {
+		return errors.New("health check failed: bad response message")
+	}
+
+	// HealthCheckResponse only has the status, as field 1. An empty message
+	// means the status is zero, which is UNKNOWN.
+	serving := uint64(0)
+	rdr := bytes.NewReader(body[5:])
+	for {
+		tag, err := binary.ReadUvarint(rdr)
+		if err == io.EOF {
+			break
+		} else if err != nil || tag&0x7 != 0 {
+			return errors.New("health check failed: bad response message")
+		}
+		value, err := binary.ReadUvarint(rdr)
+		if err != nil {
+			return errors.New("health check failed: bad response message")
+		}
+		if tag>>3 == 1 {
+			serving = value
+		}
+	}
+	if serving != GRPC_HEALTH_SERVING {
+		return errors.New(fmt.Sprintf("health check failed: status %d", serving))
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+/*
+	gobal - gzip.go
+
+	Compressed responses for the web server role. With enable_gzip_static, a
+	client that accepts gzip is sent foo.js.gz instead of foo.js, if it's
+	there. With enable_gzip, text and the like are compressed as we send
+	them; the results are kept in a cache, as the same few files tend to be
+	asked for over and over.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// defaultGzipTypes are the content types we compress unless told otherwise.
+// Anything that's already compressed, such as images, won't get smaller.
+var defaultGzipTypes = []string{
+	"text/*",
+	"application/javascript",
+	"application/json",
+	"application/wasm",
+	"application/xml",
+	"image/svg+xml",
+}
+
+// GzipCache holds compressed copies of files, up to a total size in bytes.
+// Entries are keyed by the file's path and entity tag, so a file that
+// changes is compressed again. It also keeps track of the files being
+// compressed right now, so that nobody else compresses them at the same time.
+type GzipCache struct {
+	lock    sync.Mutex
+	max     int64
+	size    int64
+	entries map[string][]byte
+	pending map[string]*gzipCall
+}
+
+// gzipCall is a file being compressed. Anyone else who wants it waits for
+// done to be closed, then takes the result.
+type gzipCall struct {
+	done chan bool
+	data []byte
+	err  error
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// Compressing files
+//////////////////////////////////////////////////////////////////////////////
+
+// AcceptsGzip returns true if the client will take a gzipped response. What
+// it says about gzip itself wins over what it says about *, and either can
+// turn gzip off with q=0.
+func AcceptsGzip(req *http.Request) bool {
+	gzipQ, starQ := -1.0, -1.0
+	for _, value := range req.Header["Accept-Encoding"] {
+		for _, coding := range strings.Split(value, ",") {
+			parts := strings.Split(coding, ";")
+			name := strings.ToLower(strings.TrimSpace(parts[0]))
+			if name != "gzip" && name != "*" {
+				continue
+			}
+			q := 1.0
+			for _, param := range parts[1:] {
+				param = strings.ToLower(strings.TrimSpace(param))
+				if strings.HasPrefix(param, "q=") {
+					q, _ = strconv.ParseFloat(param[2:], 64)
+				}
+			}
+			if name == "gzip" {
+				gzipQ = q
+			} else {
+				starQ = q
+			}
+		}
+	}
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+	return starQ > 0
+}
+
+// precompressed opens the .gz next to a file, if we're allowed to use it and
+// it exists. Returns nil otherwise.
+func (s *Service) precompressed(req *http.Request, filepath string) *CachedFile {
+	if !s.GzipStatic || !AcceptsGzip(req) {
+		return nil
+	}
+	cf, err := s.files.Open(filepath + ".gz")
+	if err != nil {
+		return nil
+	}
+	if cf.Info.IsDir() {
+		s.files.Release(cf)
+		return nil
+	}
+	return cf
+}
+
+// shouldGzip returns true if we'd compress a file as we send it. Clients
+// asking for ranges get the file as it is, so the ranges mean something.
+func (s *Service) shouldGzip(req *http.Request, ctype string, size int64) bool {
+	if !s.Gzip || size < s.GzipMinLength || size > s.GzipMaxLength {
+		return false
+	}
+	if req.Header.Get("Range") != "" || !AcceptsGzip(req) {
+		return false
+	}
+
+	ctype = strings.TrimSpace(strings.SplitN(ctype, ";", 2)[0])
+	types := s.GzipTypes
+	if types == nil {
+		types = defaultGzipTypes
+	}
+	for _, t := range types {
+		if t == ctype ||
+			(strings.HasSuffix(t, "/*") && strings.HasPrefix(ctype, t[:len(t)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipFile returns a compressed copy of a file, from the cache if we can.
+func (s *Service) gzipFile(filepath, etag string, cf *CachedFile) ([]byte, error) {
+	data, fresh, err := s.gzipCache.Compress(gzipCacheKey(filepath, etag),
+		func() ([]byte, error) {
+			var buf bytes.Buffer
+			zw := gzip.NewWriter(&buf)
+			_, err := io.Copy(zw, io.NewSectionReader(cf.File, 0,
+				cf.Info.Size()))
+			if err == nil {
+				err = zw.Close()
+			}
+			return buf.Bytes(), err
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	if fresh {
+		s.Stats.Add("gzip.compressed", 1)
+	} else {
+		s.Stats.Add("gzip.cache_hits", 1)
+	}
+	return data, nil
+}
+
+// sendGzipped sends a file compressed. The file is released once we've read
+// it, as the compressed copy is all we need from then on.
+func (s *Service) sendGzipped(req ServiceRequest, resp *http.Response,
+	filepath, etag, ctype string, cf *CachedFile) {
+	resp.StatusCode = http.StatusOK
+	resp.Status = StatusForCode(resp.StatusCode)
+	resp.Header.Set("Content-Type", ctype)
+	resp.Header.Set("Content-Encoding", "gzip")
+
+	// HEAD isn't worth compressing a file for, so it only gets a length if
+	// we happen to have the compressed copy already.
+	if req.request.Method == "HEAD" {
+		s.files.Release(cf)
+		if data := s.gzipCache.Get(gzipCacheKey(filepath, etag)); data != nil {
+			resp.ContentLength = int64(len(data))
+			resp.Header.Set("Content-Length", strconv.Itoa(len(data)))
+		} else {
+			resp.ContentLength = -1
+			resp.TransferEncoding = []string{"chunked"}
+		}
+		s.respond(req, resp)
+		return
+	}
+
+	data, err := s.gzipFile(filepath, etag, cf)
+	s.files.Release(cf)
+	if err != nil {
+		s.respond(req, HttpErrorResponse(req.request, err))
+		return
+	}
+	resp.ContentLength = int64(len(data))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+	s.respond(req, resp)
+}
+
+// gzipCacheKey is what the compressed copy of a file is stored under.
+func gzipCacheKey(filepath, etag string) string {
+	return filepath + " " + etag
+}
+
+// gzipEtag is the entity tag for the compressed version of a file. It has to
+// be different from the original's.
+func gzipEtag(etag string) string {
+	return strings.TrimSuffix(etag, "\"") + "-gz\""
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// GzipCache implementation
+//////////////////////////////////////////////////////////////////////////////
+
+// NewGzipCache makes a cache that holds up to max bytes of compressed files.
+// With a max of zero, nothing is kept.
+func NewGzipCache(max int64) *GzipCache {
+	return &GzipCache{
+		max:     max,
+		entries: make(map[string][]byte),
+		pending: make(map[string]*gzipCall),
+	}
+}
+
+// Get returns the compressed copy stored under a key, or nil.
+func (c *GzipCache) Get(key string) []byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.entries[key]
+}
+
+// Compress returns the compressed copy stored under a key. If there isn't
+// one, compress is called to make it, which is then stored. Only one call
+// to compress is made for a key at a time; anyone else after the same key
+// waits for it. fresh is true if this call did the compressing.
+func (c *GzipCache) Compress(key string,
+	compress func() ([]byte, error)) (data []byte, fresh bool, err error) {
+	c.lock.Lock()
+	if cached := c.entries[key]; cached != nil {
+		c.lock.Unlock()
+		return cached, false, nil
+	}
+	if call, ok := c.pending[key]; ok {
+		c.lock.Unlock()
+		<-call.done
+		return call.data, false, call.err
+	}
+	call := &gzipCall{done: make(chan bool)}
+	c.pending[key] = call
+	c.lock.Unlock()
+
+	call.data, call.err = compress()
+	if call.err == nil {
+		c.Put(key, call.data)
+	}
+	c.lock.Lock()
+	delete(c.pending, key)
+	c.lock.Unlock()
+	close(call.done)
+	return call.data, true, call.err
+}
+
+// Put stores a compressed copy. If we're full, other things are thrown out to
+// make room; this isn't LRU, what goes is whatever the map gives us first,
+// which is near enough random. Anything bigger than the whole cache isn't
+// kept.
+func (c *GzipCache) Put(key string, data []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if int64(len(data)) > c.max {
+		return
+	}
+	if old, ok := c.entries[key]; ok {
+		c.size -= int64(len(old))
+		delete(c.entries, key)
+	}
+	for k, old := range c.entries {
+		if c.size+int64(len(data)) <= c.max {
+			break
+		}
+		c.size -= int64(len(old))
+		delete(c.entries, k)
+	}
+	c.entries[key] = data
+	c.size += int64(len(data))
+}
@@ -0,0 +1,121 @@
+/*
+	gobal - gzip_test.go
+
+	Tests for deciding when to compress, and for the compressed file cache.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		value   string
+		accepts bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"GZIP", true},
+		{"deflate, gzip", true},
+		{"gzip;q=0.5", true},
+		{"gzip; Q=0.5", true},
+		{"gzip;q=0", false},
+		{"gzip;q=0.0", false},
+		{"identity", false},
+		{"*", true},
+		{"*;q=0", false},
+
+		// What's said about gzip wins over *, whichever comes first.
+		{"gzip;q=0, *", false},
+		{"*, gzip;q=0", false},
+		{"*;q=0, gzip", true},
+		{"gzip, *;q=0", true},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/", nil)
+		if test.value != "" {
+			req.Header.Set("Accept-Encoding", test.value)
+		}
+		if got := AcceptsGzip(req); got != test.accepts {
+			t.Errorf("AcceptsGzip(%q) = %v; want %v", test.value, got,
+				test.accepts)
+		}
+	}
+}
+
+func TestGzipCacheSize(t *testing.T) {
+	c := NewGzipCache(10)
+	c.Put("a", make([]byte, 4))
+	c.Put("b", make([]byte, 4))
+	if c.Get("a") == nil || c.Get("b") == nil || c.size != 8 {
+		t.Fatalf("size %d after two puts", c.size)
+	}
+
+	// Replacing an entry doesn't count it twice.
+	c.Put("a", make([]byte, 5))
+	if c.Get("b") == nil || c.size != 9 {
+		t.Fatalf("size %d after replacing", c.size)
+	}
+
+	// Something has to go to make room.
+	c.Put("c", make([]byte, 6))
+	var total int64
+	for _, data := range c.entries {
+		total += int64(len(data))
+	}
+	if c.Get("c") == nil || c.size > 10 || c.size != total {
+		t.Fatalf("size %d holding %d bytes after making room", c.size, total)
+	}
+
+	// Anything bigger than the whole cache isn't kept.
+	c.Put("d", make([]byte, 11))
+	if c.Get("d") != nil || c.Get("c") == nil {
+		t.Errorf("oversized entry was kept")
+	}
+
+	// With no room at all, nothing is kept.
+	c = NewGzipCache(0)
+	c.Put("a", []byte{1})
+	if c.Get("a") != nil {
+		t.Errorf("zero sized cache kept an entry")
+	}
+}
+
+func TestGzipCacheCompressOnce(t *testing.T) {
+	c := NewGzipCache(100)
+	start := make(chan bool)
+	var calls int32
+	compress := func() ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		<-start
+		return []byte("zz"), nil
+	}
+
+	// Whoever asks while the first is compressing waits for it, and whoever
+	// comes later finds it in the cache.
+	results := make(chan []byte)
+	for i := 0; i < 5; i++ {
+		go func() {
+			data, _, _ := c.Compress("a", compress)
+			results <- data
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(start)
+	for i := 0; i < 5; i++ {
+		if data := <-results; string(data) != "zz" {
+			t.Errorf("got %q", data)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("compressed %d times", calls)
+	}
+}
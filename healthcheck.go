@@ -0,0 +1,152 @@
+/*
+	gobal - healthcheck.go
+
+	Active health checks for the backends in a pool. Backends that fail their
+	check are skipped when we pick where to send requests until they pass
+	again.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//////////////////////////////////////////////////////////////////////////////
+// Pool health checking
+//////////////////////////////////////////////////////////////////////////////
+
+// healthCheckWorker checks every backend in the pool on an interval. This is
+// always running, but does nothing unless health checks are turned on.
+func (p *Pool) healthCheckWorker() {
+	for {
+		p.lock.Lock()
+		interval := p.healthInterval
+		kind := p.HealthCheck
+		backends := append([]*Backend{}, p.backends...)
+		p.lock.Unlock()
+
+		time.Sleep(interval)
+		if kind == "" || kind == "off" {
+			continue
+		}
+
+		for _, be := range backends {
+			go p.checkBackend(be, kind)
+		}
+	}
+}
+
+// checkBackend runs a single health check and marks the backend up or down.
+func (p *Pool) checkBackend(be *Backend, kind string) {
+	err := p.probeBackend(be, kind)
+
+	was := be.setDown(err != nil)
+	if err != nil && !was {
+		log.Warn("pool %s: backend %s is down: %s", p.Name, be.Ipport, err)
+	} else if err == nil && was {
+		log.Info("pool %s: backend %s is up", p.Name, be.Ipport)
+	}
+}
+
+// probeBackend makes a new connection to a backend and sends it a health
+// check. We don't use the idle connections as they may be stale, and we
+// want to know if new connections work. For tcp checks, connecting is all
+// there is to it.
+func (p *Pool) probeBackend(be *Backend, kind string) error {
+	if kind == "tcp" {
+		conn, err := be.Dial(nil)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	hconn, err := MakeHttpBackend(be, nil)
+	if err != nil {
+		return err
+	}
+	defer hconn.Conn.Close()
+	hconn.Conn.Conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	var req *http.Request
+	switch kind {
+	case "grpc":
+		if hconn.h2 == nil {
+			return errors.New("grpc health checks need backend_protocol h2 or h2c")
+		}
+		req, err = GrpcHealthRequest(be.Ipport, p.healthService)
+	default:
+		req, err = http.NewRequest("GET", "http://"+be.Ipport+p.healthPath, nil)
+		req.Close = true
+	}
+	if err != nil {
+		return err
+	}
+
+	resp, err := hconn.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if kind == "grpc" {
+		return CheckGrpcHealth(resp)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return errors.New(fmt.Sprintf("health check failed: status %d",
+			resp.StatusCode))
+	}
+	return nil
+}
+
+// setHealthCheck updates one of the health check settings.
+func (p *Pool) setHealthCheck(key, value string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	value = strings.TrimSpace(value)
+	switch key {
+	case "health_check":
+		switch value {
+		case "off", "tcp", "http", "grpc":
+			p.HealthCheck = value
+		default:
+			return errors.New(fmt.Sprintf("invalid health_check '%s'", value))
+		}
+
+		// Turning checks off means nobody will ever mark a backend as up
+		// again, so do it now.
+		if value == "off" {
+			for _, be := range p.backends {
+				be.setDown(false)
+			}
+		}
+	case "health_check_path":
+		if !strings.HasPrefix(value, "/") {
+			return errors.New(fmt.Sprintf("invalid health_check_path '%s'",
+				value))
+		}
+		p.healthPath = value
+	case "health_check_service":
+		p.healthService = value
+	case "health_check_interval":
+		secs, err := strconv.Atoi(value)
+		if err != nil || secs < 1 {
+			return errors.New(fmt.Sprintf("invalid health_check_interval '%s'",
+				value))
+		}
+		p.healthInterval = time.Duration(secs) * time.Second
+	}
+	return nil
+}
@@ -11,15 +11,26 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"path"
+	"strconv"
 	"strings"
 )
 
+// Client is anything that hands requests to a Service and waits for the
+// responses. This is an HttpConnection, or a single stream on a SPDY session.
+type Client interface {
+	RemoteAddr() net.Addr
+	LocalAddr() net.Addr
+	Close() error
+}
+
 type HttpConnection struct {
 	conn    net.Conn
 	BReader *bufio.Reader
@@ -31,15 +42,12 @@ type HttpConnection struct {
 // HTTP helpers
 //////////////////////////////////////////////////////////////////////////////
 
+// StatusForCode returns the reason phrase that goes with a status code.
 func StatusForCode(status int) string {
-	switch status {
-	case 200:
-		return "OK"
-	case 500:
-		return "Internal Server Error"
-	default:
-		return "Unknown"
+	if text := http.StatusText(status); text != "" {
+		return text
 	}
+	return "Unknown"
 }
 
 func CleanPath(root, uri string) (string, error) {
@@ -52,14 +60,135 @@ func CleanPath(root, uri string) (string, error) {
 
 	// Try to ensure that the user hasn't escaped from our docroot by ensuring
 	// that the docroot is still a prefix. NOTE: Join calls Clean, which will
-	// expand .. etc, so this is safe.
+	// expand .. etc, so this is safe. The prefix has to end at a separator, or
+	// /srv/www2 would be inside /srv/www.
+	root = path.Clean(root)
 	npath := path.Join(root, strings.TrimSpace(uri))
-	if !strings.HasPrefix(npath, root) {
+	if !InsideRoot(root, npath) {
 		return "", errors.New("URI escaped from root")
 	}
 	return npath, nil
 }
 
+// InsideRoot returns true if a cleaned path is root or somewhere under it.
+func InsideRoot(root, npath string) bool {
+	return npath == root ||
+		strings.HasPrefix(npath, strings.TrimSuffix(root, "/")+"/")
+}
+
+// hopHeaders are only meaningful for a single connection and must not be
+// passed through a proxy.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Upgrade",
+}
+
+// HasToken returns true if one of the comma separated values of a header is
+// token, ignoring case. This is for headers like Connection.
+func HasToken(hdr http.Header, name, token string) bool {
+	for _, val := range hdr[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(val, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RemoveHopHeaders strips the hop-by-hop headers, including anything named in
+// the Connection header, so we can pass a message on to the other side.
+func RemoveHopHeaders(hdr http.Header) {
+	for _, val := range hdr["Connection"] {
+		for _, name := range strings.Split(val, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				hdr.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		hdr.Del(name)
+	}
+}
+
+// forwardedHeaders describe the path a request took through proxies. We only
+// believe what's in them if the request came from a proxy we trust.
+var forwardedHeaders = []string{
+	"Forwarded",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+}
+
+// SetForwardedHeaders tells the backend about the client that sent a request.
+// The client's address is appended to X-Forwarded-For, and the protocol and
+// host are set unless a trusted proxy already did. If rfc7239 is set, the
+// same goes into a Forwarded header. Values from untrusted clients are
+// thrown away.
+func SetForwardedHeaders(req *http.Request, client net.Addr, trusted,
+	rfc7239 bool) {
+	if !trusted {
+		for _, name := range forwardedHeaders {
+			req.Header.Del(name)
+		}
+	}
+
+	ip := client.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+
+	appendHeader(req.Header, "X-Forwarded-For", ip)
+	if req.Header.Get("X-Forwarded-Proto") == "" {
+		req.Header.Set("X-Forwarded-Proto", proto)
+	}
+	if req.Header.Get("X-Forwarded-Host") == "" && req.Host != "" {
+		req.Header.Set("X-Forwarded-Host", req.Host)
+	}
+
+	if rfc7239 {
+		node := ip
+		if strings.Contains(ip, ":") {
+			node = "\"[" + ip + "]\""
+		}
+		elem := fmt.Sprintf("for=%s;proto=%s", node, proto)
+		if req.Host != "" {
+			elem += fmt.Sprintf(";host=%q", req.Host)
+		}
+		appendHeader(req.Header, "Forwarded", elem)
+	}
+}
+
+// appendHeader adds a value to the end of a comma separated header, folding
+// any existing values into one.
+func appendHeader(hdr http.Header, name, value string) {
+	if prior := hdr.Values(name); len(prior) > 0 {
+		value = strings.Join(prior, ", ") + ", " + value
+	}
+	hdr.Set(name, value)
+}
+
+// TlsState returns the state of a TLS connection for an http.Request, so we
+// can tell which requests came in over TLS. Returns nil for other connections.
+func TlsState(conn net.Conn) *tls.ConnectionState {
+	tconn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := tconn.ConnectionState()
+	return &state
+}
+
 // HttpSimpleResponse puts together a very simple, very boring response.
 func HttpSimpleResponse(req *http.Request, status int,
 	body string) *http.Response {
@@ -67,6 +196,9 @@ func HttpSimpleResponse(req *http.Request, status int,
 		Request:       req,
 		Status:        StatusForCode(status),
 		StatusCode:    status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
 		ContentLength: int64(len(body)),
 		Body:          ioutil.NopCloser(strings.NewReader(body)),
 	}
@@ -100,6 +232,14 @@ func HttpAcceptor(conn net.Conn, svc *Service, ipport string) error {
 func (h *HttpConnection) pump() {
 	defer h.Close()
 
+	// Clients that know we speak HTTP/2 send the preface instead of a request.
+	// Over TLS this is negotiated with ALPN instead, so we only look here.
+	_, isTls := h.conn.(*tls.Conn)
+	if h.Service.EnableHttp2 && !isTls && h.sawHttp2Preface() {
+		ServeHttp2(&bufferedConn{h.conn, h.BReader}, h.Service, nil, nil)
+		return
+	}
+
 	for {
 		req, err := h.ReadRequest()
 		if err != nil {
@@ -107,6 +247,20 @@ func (h *HttpConnection) pump() {
 			return
 		}
 
+		if h.Service.EnableHttp2 && !isTls {
+			if settings, ok := Http2Upgrade(h, req); ok {
+				ServeHttp2(&bufferedConn{h.conn, h.BReader}, h.Service, req,
+					settings)
+				return
+			}
+		}
+
+		// Verified client certificates are passed on to the backend.
+		req.TLS = TlsState(h.conn)
+		if h.Service.ClientAuth != nil {
+			h.Service.ClientAuth.SetIdentity(h.conn, req)
+		}
+
 		// We get here when we've received the headers. It could have body that
 		// we are still waiting on, but that's OK. The included Body member
 		// is a ReadCloser that will fetch only exactly what is in the body.
@@ -120,19 +274,94 @@ func (h *HttpConnection) pump() {
 		}
 
 		resp := <-rchan
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			h.spliceUpgrade(resp)
+			return
+		}
 
-		// TODO: Fix up response with keepalive, something like:
-		//   h.setupKeepalive(req, resp)
+		// Clients that asked us to close are told we're doing so.
+		if req.Close {
+			resp.Close = true
+		}
 
-		if err := h.WriteResponse(resp); err != nil {
+		err = h.WriteResponse(resp)
+		if resp.Body != nil {
+			resp.Body.Close()
+		}
+		if err != nil {
 			// We don't know what state the connection is in. Maybe we wrote
 			// half a response already? Log the error then abort this conn.
 			log.Error("pump failed: %s", err)
 			return
 		}
+		if closeAfter(req, resp) {
+			return
+		}
+	}
+}
+
+// closeAfter returns true if a connection can't be used again after a
+// response: either side asked for it to be closed, or the body has no length
+// and only ends when the connection does.
+func closeAfter(req *http.Request, resp *http.Response) bool {
+	if req.Close || resp.Close {
+		return true
+	}
+	if req.Method == "HEAD" || resp.StatusCode < 200 ||
+		resp.StatusCode == http.StatusNoContent ||
+		resp.StatusCode == http.StatusNotModified {
+		return false
+	}
+	for _, te := range resp.TransferEncoding {
+		if te == "chunked" {
+			return false
+		}
+	}
+	return resp.ContentLength < 0
+}
+
+// spliceUpgrade sends the response to a request that switched protocols, then
+// hands the connection over to the backend until one side closes.
+func (h *HttpConnection) spliceUpgrade(resp *http.Response) {
+	backend, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		log.Error("spliceUpgrade: response has no connection")
+		return
+	}
+
+	// The body isn't a body, so don't let the response writer near it.
+	resp.Body = nil
+	if err := h.WriteResponse(resp); err != nil {
+		log.Error("spliceUpgrade: %s", err)
+		backend.Close()
+		return
+	}
+
+	stats := h.Service.Stats
+	stats.Add("upgrade.total", 1)
+	stats.Add("upgrade.active", 1)
+	in, out, idle := Splice(&bufferedConn{h.conn, h.BReader}, backend,
+		h.Service.UpgradeIdle)
+	stats.Add("upgrade.active", -1)
+	stats.Add("upgrade.bytes_in", in)
+	stats.Add("upgrade.bytes_out", out)
+	if idle {
+		stats.Add("upgrade.idle_timeouts", 1)
+	}
+	log.Debug("spliceUpgrade: done, %d bytes in, %d bytes out", in, out)
+}
 
-		// TODO: Close the connection if we're not doing keepalive.
+// sawHttp2Preface peeks at the start of the connection to see if the client
+// is speaking HTTP/2. Nothing is consumed, either way.
+func (h *HttpConnection) sawHttp2Preface() bool {
+	// Check the first few bytes before asking for the whole preface, as an
+	// HTTP/1 request could be shorter than that.
+	start, err := h.BReader.Peek(3)
+	if err != nil || string(start) != HTTP2_PREFACE[0:3] {
+		return false
 	}
+	preface, err := h.BReader.Peek(len(HTTP2_PREFACE))
+	return err == nil && string(preface) == HTTP2_PREFACE
 }
 
 // ReadRequest reads in an http.Request object from the underlying transport.
@@ -147,10 +376,66 @@ func (h *HttpConnection) ReadRequest() (*http.Request, error) {
 // WriteResponse takes an http.Response object and writes it out to the
 // underlying transport, returning any errors.
 func (h *HttpConnection) WriteResponse(r *http.Response) error {
+	if body := sendableBody(r); body != nil {
+		return h.writeFileResponse(r, body)
+	}
 	if err := r.Write(h.BWriter); err != nil {
 		return err
 	}
-	return nil
+	return h.BWriter.Flush()
+}
+
+// writeFileResponse sends a response whose body is a file. We write the
+// headers ourselves, then the file goes straight to the connection rather
+// than through our buffers.
+func (h *HttpConnection) writeFileResponse(r *http.Response, body *fileBody) error {
+	hdr := r.Header.Clone()
+	hdr.Set("Content-Length", strconv.FormatInt(r.ContentLength, 10))
+	hdr.Del("Transfer-Encoding")
+	if r.Close {
+		hdr.Set("Connection", "close")
+	}
+
+	fmt.Fprintf(h.BWriter, "HTTP/1.1 %d %s\r\n", r.StatusCode,
+		StatusForCode(r.StatusCode))
+	if err := hdr.Write(h.BWriter); err != nil {
+		return err
+	}
+	h.BWriter.WriteString("\r\n")
+	if err := h.BWriter.Flush(); err != nil {
+		return err
+	}
+
+	// This goes around the statsBody, so it has to be told what we sent.
+	n, err := body.SendTo(h.conn)
+	if sb, ok := r.Body.(*statsBody); ok {
+		sb.sent += n
+	}
+	if err == nil && n != r.ContentLength {
+		err = errors.New(fmt.Sprintf("sent %d of %d bytes", n, r.ContentLength))
+	}
+	return err
+}
+
+// sendableBody returns the body of a response if it's a file that we can
+// send without copying it, or nil.
+func sendableBody(r *http.Response) *fileBody {
+	body := r.Body
+	if sb, ok := body.(*statsBody); ok {
+		body = sb.ReadCloser
+	}
+	fb, _ := body.(*fileBody)
+	return fb
+}
+
+// RemoteAddr is the address of the client on the other end.
+func (h *HttpConnection) RemoteAddr() net.Addr {
+	return h.conn.RemoteAddr()
+}
+
+// LocalAddr is the address the client connected to.
+func (h *HttpConnection) LocalAddr() net.Addr {
+	return h.conn.LocalAddr()
 }
 
 // Close discards an HTTP connection. This is a hard close and just drops the
@@ -0,0 +1,249 @@
+/*
+	gobal - http2.go
+
+	HTTP/2 support for clients. The framing is handled by the http2 package and
+	we turn each stream into a request for our Service.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/http2"
+)
+
+// HTTP2_PREFACE is what a client speaking HTTP/2 with prior knowledge sends
+// before anything else.
+const HTTP2_PREFACE = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+var http2Server = &http2.Server{}
+
+// Http2Session is a connection from a client speaking HTTP/2. It implements
+// http.Handler, which is called by the http2 package once per stream.
+type Http2Session struct {
+	conn    net.Conn
+	Service *Service
+}
+
+// Http2Stream is a single request on an Http2Session.
+type Http2Stream struct {
+	Session *Http2Session
+	w       http.ResponseWriter
+	abort   chan bool
+	once    sync.Once
+}
+
+// bufferedConn lets us hand a connection to the http2 package after we have
+// already read some of it into a bufio.Reader.
+type bufferedConn struct {
+	net.Conn
+	rdr *bufio.Reader
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// Http2Session base implementation
+//////////////////////////////////////////////////////////////////////////////
+
+// Http2Acceptor takes a connection that we know is speaking HTTP/2, either
+// because it was negotiated with ALPN or we saw the preface.
+func Http2Acceptor(conn net.Conn, svc *Service, ipport string) error {
+	go ServeHttp2(conn, svc, nil, nil)
+	return nil
+}
+
+// ServeHttp2 runs an HTTP/2 session until the client goes away. If the client
+// upgraded from HTTP/1.1, the request and its settings are passed in and the
+// response to that request goes out as the first stream.
+func ServeHttp2(conn net.Conn, svc *Service, upgrade *http.Request,
+	settings []byte) {
+	defer conn.Close()
+
+	sess := &Http2Session{
+		conn:    conn,
+		Service: svc,
+	}
+	http2Server.ServeConn(conn, &http2.ServeConnOpts{
+		Handler:        sess,
+		UpgradeRequest: upgrade,
+		Settings:       settings,
+	})
+	log.Debug("Http2Session closing")
+}
+
+// Http2Upgrade checks to see if an HTTP/1.1 request is asking to upgrade to
+// h2c. If so, we send the 101 and return the settings the client sent. We
+// don't upgrade requests with bodies, or ones that don't ask properly with
+// Connection: Upgrade, HTTP2-Settings and exactly one HTTP2-Settings header;
+// those are just handled as HTTP/1.1.
+func Http2Upgrade(h *HttpConnection, req *http.Request) ([]byte, bool) {
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "h2c") {
+		return nil, false
+	}
+	if !HasToken(req.Header, "Connection", "upgrade") ||
+		!HasToken(req.Header, "Connection", "http2-settings") {
+		return nil, false
+	}
+	if req.Body != http.NoBody || req.ContentLength > 0 {
+		return nil, false
+	}
+	values := req.Header["Http2-Settings"]
+	if len(values) != 1 {
+		return nil, false
+	}
+	settings, err := base64.RawURLEncoding.DecodeString(
+		strings.TrimRight(values[0], "="))
+	if err != nil {
+		return nil, false
+	}
+
+	h.BWriter.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Connection: Upgrade\r\nUpgrade: h2c\r\n\r\n")
+	if err := h.BWriter.Flush(); err != nil {
+		return nil, false
+	}
+	return settings, true
+}
+
+// ServeHTTP is called by the http2 package for each new stream. We hand the
+// request to our Service and write out whatever it gives back.
+func (sess *Http2Session) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	st := &Http2Stream{
+		Session: sess,
+		w:       w,
+		abort:   make(chan bool),
+	}
+
+	if sess.Service.ClientAuth != nil {
+		sess.Service.ClientAuth.SetIdentity(sess.conn, req)
+	}
+
+	rchan := make(chan *http.Response, 1)
+	var resp *http.Response
+	if err := sess.Service.HandleRequest(st, req, rchan); err != nil {
+		resp = HttpErrorResponse(req, err)
+	} else {
+		resp = <-rchan
+	}
+
+	err := st.WriteResponse(resp)
+	if resp.Body != nil {
+		resp.Body.Close()
+	}
+	if err == nil && st.aborted() {
+		err = errors.New("stream aborted")
+	}
+	if err != nil {
+		// This resets the stream rather than ending it cleanly, so the client
+		// knows it didn't get the whole response.
+		log.Debug("Http2Stream: aborting: %s", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// Http2Stream implementation
+//////////////////////////////////////////////////////////////////////////////
+
+// WriteResponse sends a response back on this stream. The body is flushed as
+// we go so that streaming responses aren't held up.
+func (st *Http2Stream) WriteResponse(resp *http.Response) error {
+	hdr := st.w.Header()
+	for name, values := range resp.Header {
+		hdr[name] = values
+	}
+	RemoveHopHeaders(hdr)
+	hdr.Del("Transfer-Encoding")
+	st.w.WriteHeader(resp.StatusCode)
+
+	if resp.Body == nil {
+		return nil
+	}
+
+	flusher, _ := st.w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := st.w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			st.writeTrailers(resp)
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if st.aborted() {
+			return errors.New("stream aborted")
+		}
+	}
+}
+
+// writeTrailers passes on any trailers that came with the response. These
+// aren't known until the body has been read, and gRPC depends on them.
+func (st *Http2Stream) writeTrailers(resp *http.Response) {
+	hdr := st.w.Header()
+	for name, values := range resp.Trailer {
+		if len(values) > 0 {
+			hdr[http.TrailerPrefix+name] = values
+		}
+	}
+}
+
+// RemoteAddr is the address of the client that opened this stream.
+func (st *Http2Stream) RemoteAddr() net.Addr {
+	return st.Session.conn.RemoteAddr()
+}
+
+// LocalAddr is the address the client connected to.
+func (st *Http2Stream) LocalAddr() net.Addr {
+	return st.Session.conn.LocalAddr()
+}
+
+// aborted returns true if someone has called Close on this stream.
+func (st *Http2Stream) aborted() bool {
+	select {
+	case <-st.abort:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close aborts the stream. We can only actually reset it from the handler,
+// so this just marks it and the handler does the rest.
+func (st *Http2Stream) Close() error {
+	st.once.Do(func() { close(st.abort) })
+	return nil
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// bufferedConn implementation
+//////////////////////////////////////////////////////////////////////////////
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.rdr.Read(p)
+}
+
+// CloseWrite shuts down our side of the connection, if the connection
+// underneath supports it.
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("connection can't be half closed")
+}
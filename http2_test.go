@@ -0,0 +1,91 @@
+/*
+	gobal - http2_test.go
+
+	Tests for upgrading HTTP/1.1 connections to h2c.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHttp2Upgrade(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  map[string][]string
+		body    string
+		upgrade bool
+	}{
+		{"proper", map[string][]string{
+			"Connection":     {"Upgrade, HTTP2-Settings"},
+			"Upgrade":        {"h2c"},
+			"Http2-Settings": {"AAMAAABkAAQAAP__"},
+		}, "", true},
+		{"connection split over headers", map[string][]string{
+			"Connection":     {"upgrade", "http2-settings"},
+			"Upgrade":        {"H2C"},
+			"Http2-Settings": {"AAMAAABkAAQAAP__"},
+		}, "", true},
+
+		{"no HTTP2-Settings in Connection", map[string][]string{
+			"Connection":     {"Upgrade"},
+			"Upgrade":        {"h2c"},
+			"Http2-Settings": {"AAMAAABkAAQAAP__"},
+		}, "", false},
+		{"no Upgrade in Connection", map[string][]string{
+			"Connection":     {"HTTP2-Settings"},
+			"Upgrade":        {"h2c"},
+			"Http2-Settings": {"AAMAAABkAAQAAP__"},
+		}, "", false},
+		{"no HTTP2-Settings", map[string][]string{
+			"Connection": {"Upgrade, HTTP2-Settings"},
+			"Upgrade":    {"h2c"},
+		}, "", false},
+		{"two HTTP2-Settings", map[string][]string{
+			"Connection":     {"Upgrade, HTTP2-Settings"},
+			"Upgrade":        {"h2c"},
+			"Http2-Settings": {"AAMAAABkAAQAAP__", "AAMAAABkAAQAAP__"},
+		}, "", false},
+		{"bad HTTP2-Settings", map[string][]string{
+			"Connection":     {"Upgrade, HTTP2-Settings"},
+			"Upgrade":        {"h2c"},
+			"Http2-Settings": {"!!"},
+		}, "", false},
+		{"websocket", map[string][]string{
+			"Connection": {"Upgrade"},
+			"Upgrade":    {"websocket"},
+		}, "", false},
+		{"body", map[string][]string{
+			"Connection":     {"Upgrade, HTTP2-Settings"},
+			"Upgrade":        {"h2c"},
+			"Http2-Settings": {"AAMAAABkAAQAAP__"},
+		}, "data", false},
+	}
+
+	for _, test := range tests {
+		var req *http.Request
+		if test.body != "" {
+			req, _ = http.NewRequest("POST", "/", strings.NewReader(test.body))
+		} else {
+			req, _ = http.NewRequest("GET", "/", http.NoBody)
+		}
+		req.Header = test.header
+
+		var out bytes.Buffer
+		h := &HttpConnection{BWriter: bufio.NewWriter(&out)}
+		_, ok := Http2Upgrade(h, req)
+		if ok != test.upgrade {
+			t.Errorf("%s: upgraded %v", test.name, ok)
+		}
+		if ok != strings.HasPrefix(out.String(), "HTTP/1.1 101 ") {
+			t.Errorf("%s: wrote %q", test.name, out.String())
+		}
+	}
+}
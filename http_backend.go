@@ -8,11 +8,40 @@
 
 package main
 
-import ()
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
 
+	"golang.org/x/net/http2"
+)
+
+var http2Transport = &http2.Transport{}
+
+// HttpBackendConnection is a connection to a backend. For HTTP/1.1 this is
+// used by one request at a time. For HTTP/2, the pool keeps one of these per
+// connection and hands out a separate one sharing it for every request.
 type HttpBackendConnection struct {
-	Conn   *TcpConnection
-	Client *HttpConnection
+	Conn    *TcpConnection
+	Client  Client
+	Backend *Backend
+
+	// Internal state management variables
+	reused  bool
+	private bool
+	h2      *http2.ClientConn
+}
+
+// backendBody wraps the body of a response from a backend. Once the client
+// side is done with it, the backend connection is either put back into the
+// pool for the next request or closed.
+type backendBody struct {
+	io.ReadCloser
+	conn   *HttpBackendConnection
+	reuse  bool
+	closed bool
 }
 
 //////////////////////////////////////////////////////////////////////////////
@@ -20,19 +49,112 @@ type HttpBackendConnection struct {
 //////////////////////////////////////////////////////////////////////////////
 
 // HttpBackend creates a connection to a backend, setting up the various
-// data structures that we need and initiating the connection.
-func MakeHttpBackend(be *Backend) error {
-	conn, err := MakeTcpConnection(be.Ipport)
+// data structures that we need and initiating the connection. If it's made
+// for a particular client, it isn't shared with anyone else.
+func MakeHttpBackend(be *Backend, src ProxySource) (*HttpBackendConnection, error) {
+	conn, err := be.Dial(src)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	hconn := HttpBackendConnection{
-		Conn:   conn,
-		Client: nil,
+	hconn := &HttpBackendConnection{
+		Conn:    conn,
+		Client:  nil,
+		Backend: be,
+		private: src != nil,
 	}
 
-	return nil
+	if be.pool.Multiplexed() {
+		if tconn, ok := conn.Conn.(*tls.Conn); ok {
+			proto := tconn.ConnectionState().NegotiatedProtocol
+			if proto != "h2" {
+				conn.Close()
+				return nil, errors.New(fmt.Sprintf(
+					"backend %s negotiated '%s' instead of h2", be.Ipport, proto))
+			}
+		}
+		hconn.h2, err = http2Transport.NewClientConn(conn.Conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return hconn, nil
+}
+
+// RoundTrip sends a request to the backend and reads the response headers.
+// The body of the response is left for the caller to read.
+func (h *HttpBackendConnection) RoundTrip(req *http.Request) (*http.Response, error) {
+	if h.h2 != nil {
+		return h.roundTripHttp2(req)
+	}
+
+	if err := req.Write(h.Conn.BWriter); err != nil {
+		return nil, err
+	}
+	if err := h.Conn.BWriter.Flush(); err != nil {
+		return nil, err
+	}
+	return http.ReadResponse(h.Conn.BReader, req)
+}
+
+// roundTripHttp2 sends a request as a new stream on a multiplexed connection.
+// The response is made to look like HTTP/1.1, as that's what our clients are
+// expecting to be handed.
+func (h *HttpBackendConnection) roundTripHttp2(req *http.Request) (*http.Response, error) {
+	out := req.Clone(req.Context())
+	out.RequestURI = ""
+	out.Close = false
+	out.URL.Host = h.Backend.Ipport
+	out.URL.Scheme = "http"
+	if _, ok := h.Conn.Conn.(*tls.Conn); ok {
+		out.URL.Scheme = "https"
+	}
+
+	resp, err := h.h2.RoundTrip(out)
+	if err != nil {
+		return nil, err
+	}
+	resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+	if resp.ContentLength < 0 {
+		resp.TransferEncoding = []string{"chunked"}
+	}
+	return resp, nil
+}
+
+// Attach associates a response from this backend with the client that is
+// going to receive it. When the client is done with the body, the connection
+// is released back to the pool if reuse is set and the response allows it.
+func (h *HttpBackendConnection) Attach(client Client,
+	resp *http.Response, reuse bool) {
+	h.Client = client
+	resp.Body = &backendBody{
+		ReadCloser: resp.Body,
+		conn:       h,
+		reuse:      reuse && !resp.Close,
+	}
+}
+
+// Release is called when we're done with a backend connection. If it's still
+// in a good state, it goes back into the pool's queue of idle connections.
+func (h *HttpBackendConnection) Release(reuse bool) {
+	h.Client = nil
+	if h.h2 != nil {
+		// The stream is done, the connection stays with the pool.
+		h.Backend.pool.notifyMux()
+		return
+	}
+	if reuse && !h.private {
+		h.reused = true
+		if h.Backend.pool.ReleaseBackend(h) {
+			return
+		}
+	}
+	h.Conn.Close()
+	if !h.private {
+		h.Backend.disconnected()
+	}
 }
 
 // Close discards an HTTP connection. This is a hard close and just drops the
@@ -43,8 +165,31 @@ func (h *HttpBackendConnection) Close() error {
 			return err
 		}
 	}
+	if h.h2 != nil {
+		// Only this stream is done for. If the connection itself has gone
+		// bad, the pool notices and cleans it up.
+		h.Backend.pool.notifyMux()
+		return nil
+	}
+	if !h.private {
+		h.Backend.disconnected()
+	}
 	if err := h.Conn.Close(); err != nil {
 		return err
 	}
 	return nil
 }
+
+// Close on the body hands the backend connection back. Closing the
+// underlying body drains whatever the client didn't read, which leaves the
+// connection ready for the next request.
+func (b *backendBody) Close() error {
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+
+	err := b.ReadCloser.Close()
+	b.conn.Release(b.reuse && err == nil)
+	return err
+}
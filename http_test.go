@@ -0,0 +1,162 @@
+/*
+	gobal - http_test.go
+
+	Tests for the HTTP helpers.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestCleanPath(t *testing.T) {
+	tests := []struct {
+		root string
+		uri  string
+		path string
+		ok   bool
+	}{
+		{"/srv/www", "/index.html", "/srv/www/index.html", true},
+		{"/srv/www", "/a/b/../c", "/srv/www/a/c", true},
+		{"/srv/www", "/a/../../www/x", "/srv/www/x", true},
+		{"/srv/www", "/", "/srv/www", true},
+		{"/srv/www", "", "/srv/www", true},
+		{"/srv/www/", "/x", "/srv/www/x", true},
+		{"/", "/../etc/passwd", "/etc/passwd", true},
+
+		// Climbing out of the docroot, including into a sibling whose name
+		// starts the same.
+		{"/srv/www", "/../../etc/passwd", "", false},
+		{"/srv/www", "/..", "", false},
+		{"/srv/www", "/../www2/evil", "", false},
+		{"/srv/www", "/../www2", "", false},
+		{"/srv/www/", "/../www2/evil", "", false},
+	}
+
+	for _, test := range tests {
+		path, err := CleanPath(test.root, test.uri)
+		if (err == nil) != test.ok || path != test.path {
+			t.Errorf("CleanPath(%q, %q) = %q, %v; want %q", test.root,
+				test.uri, path, err, test.path)
+		}
+	}
+}
+
+func TestInsideRoot(t *testing.T) {
+	tests := []struct {
+		root, path string
+		inside     bool
+	}{
+		{"/srv/www", "/srv/www", true},
+		{"/srv/www", "/srv/www/a", true},
+		{"/srv/www", "/srv/www2", false},
+		{"/srv/www", "/srv", false},
+		{"/", "/anything", true},
+	}
+
+	for _, test := range tests {
+		if got := InsideRoot(test.root, test.path); got != test.inside {
+			t.Errorf("InsideRoot(%q, %q) = %v", test.root, test.path, got)
+		}
+	}
+}
+
+func TestSetForwardedHeaders(t *testing.T) {
+	v4 := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 56324}
+	v6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+	spoofed := http.Header{
+		"X-Forwarded-For":   {"10.0.0.1", "10.0.0.2"},
+		"X-Forwarded-Proto": {"https"},
+		"X-Forwarded-Host":  {"evil.com"},
+		"Forwarded":         {"for=10.0.0.1"},
+	}
+
+	tests := []struct {
+		name    string
+		client  net.Addr
+		trusted bool
+		tls     bool
+		hdr     http.Header
+		want    http.Header
+	}{
+		{"IPv4", v4, false, false, nil, http.Header{
+			"X-Forwarded-For":   {"192.0.2.1"},
+			"X-Forwarded-Proto": {"http"},
+			"X-Forwarded-Host":  {"site.com"},
+			"Forwarded":         {`for=192.0.2.1;proto=http;host="site.com"`},
+		}},
+		{"IPv6 over TLS", v6, false, true, nil, http.Header{
+			"X-Forwarded-For":   {"2001:db8::1"},
+			"X-Forwarded-Proto": {"https"},
+			"X-Forwarded-Host":  {"site.com"},
+			"Forwarded": {
+				`for="[2001:db8::1]";proto=https;host="site.com"`},
+		}},
+
+		// What an untrusted client says about itself is replaced...
+		{"untrusted", v4, false, false, spoofed, http.Header{
+			"X-Forwarded-For":   {"192.0.2.1"},
+			"X-Forwarded-Proto": {"http"},
+			"X-Forwarded-Host":  {"site.com"},
+			"Forwarded":         {`for=192.0.2.1;proto=http;host="site.com"`},
+		}},
+
+		// ...but a trusted proxy's is kept, and we add to the end.
+		{"trusted", v4, true, false, spoofed, http.Header{
+			"X-Forwarded-For":   {"10.0.0.1, 10.0.0.2, 192.0.2.1"},
+			"X-Forwarded-Proto": {"https"},
+			"X-Forwarded-Host":  {"evil.com"},
+			"Forwarded": {
+				`for=10.0.0.1, for=192.0.2.1;proto=http;host="site.com"`},
+		}},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "http://site.com/", nil)
+		for name, values := range test.hdr {
+			req.Header[name] = append([]string{}, values...)
+		}
+		if test.tls {
+			req.TLS = &tls.ConnectionState{}
+		}
+
+		SetForwardedHeaders(req, test.client, test.trusted, true)
+		for name, want := range test.want {
+			if got := req.Header[name]; len(got) != len(want) ||
+				got[0] != want[0] {
+				t.Errorf("%s: %s is %q; want %q", test.name, name, got, want)
+			}
+		}
+
+		// Without RFC 7239, there's no Forwarded header of our own.
+		req.Header = make(http.Header)
+		SetForwardedHeaders(req, test.client, test.trusted, false)
+		if req.Header["Forwarded"] != nil {
+			t.Errorf("%s: Forwarded set without rfc7239", test.name)
+		}
+	}
+}
+
+func TestRemoveHopHeaders(t *testing.T) {
+	hdr := http.Header{
+		"Connection":   {"keep-alive, X-Secret", " x-other ,"},
+		"Keep-Alive":   {"timeout=5"},
+		"Upgrade":      {"websocket"},
+		"Te":           {"trailers"},
+		"X-Secret":     {"1"},
+		"X-Other":      {"2"},
+		"X-Kept":       {"3"},
+		"Content-Type": {"text/plain"},
+	}
+	RemoveHopHeaders(hdr)
+	if len(hdr) != 2 || hdr.Get("X-Kept") != "3" ||
+		hdr.Get("Content-Type") != "text/plain" {
+		t.Errorf("left %v", hdr)
+	}
+}
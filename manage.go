@@ -0,0 +1,101 @@
+/*
+	gobal - manage.go
+
+	Commands for the management port. Anything we don't handle here is passed
+	on to the configuration engine, so you can reconfigure things on the fly.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+type ManageFunc func(*TcpConnection, []string) error
+
+// ManageMap works just like ConfigMap, but these commands only make sense on
+// a live management connection. Plugins may add to it from their init.
+var ManageMap map[string]ManageFunc = map[string]ManageFunc{
+	`^RELOAD\s+CERTS\s+(\w+)$`:    mgmt_ReloadCerts,
+	`^SHOW\s+STATS(?:\s+(\w+))?$`: mgmt_ShowStats,
+	`^SHOW\s+UPLOADS$`:            mgmt_ShowUploads,
+}
+
+// mgmt_ReloadCerts rereads the certificates for a TLS service from disk,
+// along with the CRL used to check client certificates.
+func mgmt_ReloadCerts(c *TcpConnection, m []string) error {
+	svc, ok := GetService(m[1])
+	if !ok {
+		return errors.New(fmt.Sprintf("service '%s' not found", m[1]))
+	}
+	if svc.Certs == nil {
+		return errors.New(fmt.Sprintf("service '%s' does not have ssl enabled",
+			m[1]))
+	}
+	if err := svc.Certs.Reload(); err != nil {
+		return err
+	}
+	if svc.ClientAuth != nil {
+		return svc.ClientAuth.Reload()
+	}
+	return nil
+}
+
+// mgmt_ShowStats prints the counters for one service, or all of them, as
+// lines of "service counter value".
+func mgmt_ShowStats(c *TcpConnection, m []string) error {
+	serviceLock.Lock()
+	var names []string
+	stats := make(map[string]*ServiceStats)
+	for name, svc := range services {
+		if m[1] == "" || m[1] == name {
+			names = append(names, name)
+			stats[name] = svc.Stats
+		}
+	}
+	serviceLock.Unlock()
+
+	if len(names) == 0 && m[1] != "" {
+		return errors.New(fmt.Sprintf("service '%s' not found", m[1]))
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, counter := range stats[name].Names() {
+			c.WriteLine(fmt.Sprintf("%s %s %d", name, counter,
+				stats[name].Get(counter)))
+		}
+	}
+	return nil
+}
+
+// mgmt_ShowUploads lists the request bodies we're buffering right now, with
+// how much of each we have.
+func mgmt_ShowUploads(c *TcpConnection, m []string) error {
+	for _, progress := range Uploads() {
+		c.WriteLine(progress.String())
+	}
+	return nil
+}
+
+// runManageLine handles a single line from a management connection. We try
+// the management commands first, then fall back to the configuration engine.
+func runManageLine(c *TcpConnection, cur *Interactor, line string) error {
+	for str, fnc := range ManageMap {
+		re, err := regexp.Compile("(?i:" + str + ")")
+		if err != nil {
+			return err
+		}
+
+		m := re.FindStringSubmatch(line)
+		if m != nil {
+			return fnc(c, m)
+		}
+	}
+	return runConfigLine(cur, line)
+}
@@ -0,0 +1,107 @@
+/*
+	gobal - mime.go
+
+	Content types for the files we serve, picked by extension. There's a
+	built in table of the usual suspects, and a service can load more from a
+	file in the format of /etc/mime.types:
+
+		text/html		html htm
+		image/png		png
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"strings"
+)
+
+// DEFAULT_MIME_TYPE is used for files we don't know the type of.
+const DEFAULT_MIME_TYPE = "application/octet-stream"
+
+// MimeTypes maps extensions, without the dot and in lower case, to content
+// types.
+type MimeTypes map[string]string
+
+// builtinMimeTypes is what every service knows about.
+var builtinMimeTypes = MimeTypes{
+	"css":   "text/css; charset=utf-8",
+	"csv":   "text/csv; charset=utf-8",
+	"gif":   "image/gif",
+	"gz":    "application/gzip",
+	"htm":   "text/html; charset=utf-8",
+	"html":  "text/html; charset=utf-8",
+	"ico":   "image/x-icon",
+	"jpeg":  "image/jpeg",
+	"jpg":   "image/jpeg",
+	"js":    "application/javascript",
+	"json":  "application/json",
+	"log":   "text/plain; charset=utf-8",
+	"map":   "application/json",
+	"md":    "text/markdown; charset=utf-8",
+	"mp3":   "audio/mpeg",
+	"mp4":   "video/mp4",
+	"pdf":   "application/pdf",
+	"png":   "image/png",
+	"svg":   "image/svg+xml",
+	"tar":   "application/x-tar",
+	"tgz":   "application/gzip",
+	"txt":   "text/plain; charset=utf-8",
+	"wasm":  "application/wasm",
+	"webm":  "video/webm",
+	"webp":  "image/webp",
+	"woff":  "font/woff",
+	"woff2": "font/woff2",
+	"xml":   "text/xml; charset=utf-8",
+	"zip":   "application/zip",
+}
+
+// LoadMimeTypes reads a mime.types file. Lines are a content type followed by
+// the extensions that have it, and anything after a # is ignored.
+func LoadMimeTypes(file string) (MimeTypes, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	types := make(MimeTypes)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		for _, ext := range fields[1:] {
+			types[strings.ToLower(strings.TrimPrefix(ext, "."))] = fields[0]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return types, nil
+}
+
+// contentType picks the content type for a file, trying the service's own
+// types before the built in ones.
+func (s *Service) contentType(name string) string {
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(name), "."))
+	if ctype, ok := s.MimeTypes[ext]; ok {
+		return ctype
+	}
+	if ctype, ok := builtinMimeTypes[ext]; ok {
+		return ctype
+	}
+	if s.DefaultMimeType != "" {
+		return s.DefaultMimeType
+	}
+	return DEFAULT_MIME_TYPE
+}
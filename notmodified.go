@@ -0,0 +1,101 @@
+/*
+	gobal - notmodified.go
+
+	The NotModified plugin, for hosts that only ever serve immutable content.
+	If a client asks whether what it has is still good, it has to be, so we
+	say so without bothering a backend.
+
+		LOAD NotModified
+		SET plugins = notmodified
+		SET notmodified.host_pattern = ^immutable\.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// notModifiedPlugin keeps the host pattern for each service that uses it.
+// Services without a pattern are left alone.
+type notModifiedPlugin struct {
+	BasePlugin
+	lock     sync.RWMutex
+	patterns map[*Service]*regexp.Regexp
+}
+
+func init() {
+	RegisterPlugin(&notModifiedPlugin{
+		patterns: make(map[*Service]*regexp.Regexp),
+	})
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// notModifiedPlugin implementation
+//////////////////////////////////////////////////////////////////////////////
+
+func (p *notModifiedPlugin) Name() string {
+	return "NotModified"
+}
+
+func (p *notModifiedPlugin) Unregister(svc *Service) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.patterns, svc)
+	return nil
+}
+
+func (p *notModifiedPlugin) Set(svc *Service, key, value string) error {
+	if key != "host_pattern" {
+		return p.BasePlugin.Set(svc, key, value)
+	}
+	re, err := regexp.Compile("(?i:" + strings.TrimSpace(value) + ")")
+	if err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.patterns[svc] = re
+	return nil
+}
+
+// StartRequest answers conditional requests for matching hosts with a 304.
+func (p *notModifiedPlugin) StartRequest(svc *Service,
+	req *http.Request) *http.Response {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return nil
+	}
+	if req.Header.Get("If-Modified-Since") == "" &&
+		req.Header.Get("If-None-Match") == "" {
+		return nil
+	}
+
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	p.lock.RLock()
+	re := p.patterns[svc]
+	p.lock.RUnlock()
+	if re == nil || !re.MatchString(host) {
+		return nil
+	}
+
+	svc.Stats.Add("notmodified.hits", 1)
+	return &http.Response{
+		Request:    req,
+		Status:     StatusForCode(http.StatusNotModified),
+		StatusCode: http.StatusNotModified,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+	}
+}
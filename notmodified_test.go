@@ -0,0 +1,84 @@
+/*
+	gobal - notmodified_test.go
+
+	Tests for the NotModified plugin.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestNotModifiedStartRequest(t *testing.T) {
+	if err := LoadPlugin("NotModified"); err != nil {
+		t.Fatal(err)
+	}
+	s := &Service{Name: "test", Stats: NewServiceStats()}
+	other := &Service{Name: "other", Stats: NewServiceStats()}
+	for _, svc := range []*Service{s, other} {
+		if err := svc.Set("plugins", "notmodified"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Set("notmodified.host_pattern", `^immutable\.`); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("notmodified.host_pattern", "("); err == nil {
+		t.Errorf("took a broken pattern")
+	}
+
+	tests := []struct {
+		method string
+		host   string
+		header string
+		hit    bool
+	}{
+		{"GET", "immutable.site.com", "If-Modified-Since", true},
+		{"HEAD", "immutable.site.com", "If-None-Match", true},
+		{"GET", "IMMUTABLE.site.com:8080", "If-None-Match", true},
+
+		{"GET", "immutable.site.com", "", false},
+		{"POST", "immutable.site.com", "If-Modified-Since", false},
+		{"GET", "www.site.com", "If-Modified-Since", false},
+		{"GET", "www.immutable.com", "If-Modified-Since", false},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, "/", nil)
+		req.Host = test.host
+		if test.header != "" {
+			req.Header.Set(test.header, "x")
+		}
+		resp := s.runStartRequest(req)
+		if (resp != nil) != test.hit ||
+			(resp != nil && resp.StatusCode != http.StatusNotModified) {
+			t.Errorf("%s %s %s: got %v", test.method, test.host, test.header,
+				resp)
+		}
+
+		// A service without a pattern of its own is left alone.
+		if other.runStartRequest(req) != nil {
+			t.Errorf("%s %s %s: answered for another service", test.method,
+				test.host, test.header)
+		}
+	}
+	if got := s.Stats.Get("notmodified.hits"); got != 3 {
+		t.Errorf("counted %d hits", got)
+	}
+
+	// Turning it off forgets the pattern.
+	s.Set("plugins", "")
+	s.Set("plugins", "notmodified")
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Host = "immutable.site.com"
+	req.Header.Set("If-Modified-Since", "x")
+	if s.runStartRequest(req) != nil {
+		t.Errorf("kept the pattern after being turned off")
+	}
+	s.Set("plugins", "")
+	other.Set("plugins", "")
+}
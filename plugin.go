@@ -0,0 +1,276 @@
+/*
+	gobal - plugin.go
+
+	Plugins change how services handle requests. A plugin registers itself
+	from its init function, is loaded with a LOAD line in the configuration,
+	and is then turned on for each service that wants it:
+
+		LOAD NotModified
+
+		CREATE SERVICE demo
+		  SET plugins = vhosts, notmodified
+		  SET demo.notmodified.host_pattern = ^immutable\.
+
+	The hooks are run in the order the plugins are listed for the service.
+	Settings that are namespaced with the name of a plugin are handed to that
+	plugin, which keeps its own configuration for each service.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Plugin is the interface that all plugins implement. Most plugins only care
+// about one or two of the hooks, so they should embed BasePlugin and just
+// implement the ones they need.
+type Plugin interface {
+	// Name is what the plugin is called in LOAD and SET plugins lines. It
+	// isn't case sensitive.
+	Name() string
+
+	// Load is called the first time the plugin is loaded.
+	Load() error
+
+	// Register and Unregister are called when a service turns the plugin on
+	// or off.
+	Register(svc *Service) error
+	Unregister(svc *Service) error
+
+	// Set handles a setting namespaced with the plugin's name, such as
+	// "SET demo.notmodified.host_pattern". The key doesn't include the name.
+	Set(svc *Service, key, value string) error
+
+	// StartRequest is called when a request comes in, before anything else.
+	// If it returns a response, that is sent to the client and nothing else
+	// is done with the request.
+	StartRequest(svc *Service, req *http.Request) *http.Response
+
+	// BackendChosen is called just before a request is sent to a backend.
+	// The request can still be changed.
+	BackendChosen(svc *Service, req *http.Request, be *HttpBackendConnection)
+
+	// BackendResponse is called with a response from a backend before we
+	// look at it. The response can be changed.
+	BackendResponse(svc *Service, req *http.Request, resp *http.Response)
+
+	// ClientWrite is called with every response just before it goes to the
+	// client, whether it's from a backend or not. The response can be
+	// changed.
+	ClientWrite(svc *Service, req *http.Request, resp *http.Response)
+}
+
+// BasePlugin does nothing at all. Embed it in a plugin to get the hooks you
+// don't care about.
+type BasePlugin struct{}
+
+var pluginLock sync.Mutex
+var availablePlugins map[string]Plugin = make(map[string]Plugin)
+var loadedPlugins map[string]Plugin = make(map[string]Plugin)
+
+func init() {
+	ConfigMap[`^LOAD\s+(\w+)$`] = cfg_Load
+}
+
+// RegisterPlugin makes a plugin available to be loaded. Plugins call this from
+// their init function.
+func RegisterPlugin(plugin Plugin) {
+	pluginLock.Lock()
+	defer pluginLock.Unlock()
+
+	// This happens before logging is set up, and it's a programming error.
+	name := strings.ToLower(plugin.Name())
+	if _, ok := availablePlugins[name]; ok {
+		panic(fmt.Sprintf("plugin '%s' registered twice", name))
+	}
+	availablePlugins[name] = plugin
+}
+
+// LoadPlugin loads a plugin so that services can use it. Loading a plugin that
+// is already loaded does nothing.
+func LoadPlugin(name string) error {
+	pluginLock.Lock()
+	defer pluginLock.Unlock()
+
+	name = strings.ToLower(name)
+	if _, ok := loadedPlugins[name]; ok {
+		return nil
+	}
+	plugin, ok := availablePlugins[name]
+	if !ok {
+		return errors.New(fmt.Sprintf("plugin '%s' not found", name))
+	}
+	if err := plugin.Load(); err != nil {
+		return err
+	}
+	loadedPlugins[name] = plugin
+	return nil
+}
+
+// GetPlugin returns a plugin that has been loaded, or nil.
+func GetPlugin(name string) Plugin {
+	pluginLock.Lock()
+	defer pluginLock.Unlock()
+	return loadedPlugins[strings.ToLower(name)]
+}
+
+// cfg_Load loads a plugin.
+func cfg_Load(cur *Interactor, m []string) error {
+	return LoadPlugin(m[1])
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// Service plugin handling
+//////////////////////////////////////////////////////////////////////////////
+
+// setPlugins changes the list of plugins a service uses. New plugins are
+// registered first, and if one fails, the ones before it are unregistered
+// again and nothing changes. Then plugins that are no longer listed are
+// unregistered.
+func (s *Service) setPlugins(value string) error {
+	var list []Plugin
+	for _, name := range SplitList(value) {
+		plugin := GetPlugin(name)
+		if plugin == nil {
+			return errors.New(fmt.Sprintf("plugin '%s' is not loaded", name))
+		}
+		list = append(list, plugin)
+	}
+
+	current := s.getPlugins()
+	var added []Plugin
+	for _, plugin := range list {
+		if hasPlugin(current, plugin) || hasPlugin(added, plugin) {
+			continue
+		}
+		if err := plugin.Register(s); err != nil {
+			for i := len(added) - 1; i >= 0; i-- {
+				added[i].Unregister(s)
+			}
+			return err
+		}
+		added = append(added, plugin)
+	}
+
+	s.pluginsLock.Lock()
+	s.plugins = list
+	s.pluginsLock.Unlock()
+
+	// The new list is in place by now, so a plugin that won't let go is all
+	// we can complain about.
+	for _, old := range current {
+		if !hasPlugin(list, old) {
+			if err := old.Unregister(s); err != nil {
+				log.Error("service %s: unregistering %s: %s", s.Name,
+					old.Name(), err)
+			}
+		}
+	}
+	return nil
+}
+
+// getPlugins returns the plugins a service uses. The list can be changed
+// from the management port at any time, but it's replaced rather than
+// changed in place, so what we return stays as it is.
+func (s *Service) getPlugins() []Plugin {
+	s.pluginsLock.Lock()
+	defer s.pluginsLock.Unlock()
+	return s.plugins
+}
+
+// setPluginKey hands a namespaced setting to the plugin it's for.
+func (s *Service) setPluginKey(key, value string) error {
+	parts := strings.SplitN(key, ".", 2)
+	for _, plugin := range s.getPlugins() {
+		if strings.ToLower(plugin.Name()) == strings.ToLower(parts[0]) {
+			return plugin.Set(s, parts[1], value)
+		}
+	}
+	return errors.New(fmt.Sprintf("plugin '%s' is not enabled on service %s",
+		parts[0], s.Name))
+}
+
+// hasPlugin returns true if a plugin is in a list.
+func hasPlugin(list []Plugin, plugin Plugin) bool {
+	for _, p := range list {
+		if p == plugin {
+			return true
+		}
+	}
+	return false
+}
+
+// runStartRequest runs the StartRequest hooks until one of them answers the
+// request.
+func (s *Service) runStartRequest(req *http.Request) *http.Response {
+	for _, plugin := range s.getPlugins() {
+		if resp := plugin.StartRequest(s, req); resp != nil {
+			return resp
+		}
+	}
+	return nil
+}
+
+// runBackendChosen runs the BackendChosen hooks.
+func (s *Service) runBackendChosen(req *http.Request, be *HttpBackendConnection) {
+	for _, plugin := range s.getPlugins() {
+		plugin.BackendChosen(s, req, be)
+	}
+}
+
+// runBackendResponse runs the BackendResponse hooks.
+func (s *Service) runBackendResponse(req *http.Request, resp *http.Response) {
+	for _, plugin := range s.getPlugins() {
+		plugin.BackendResponse(s, req, resp)
+	}
+}
+
+// runClientWrite runs the ClientWrite hooks.
+func (s *Service) runClientWrite(req *http.Request, resp *http.Response) {
+	for _, plugin := range s.getPlugins() {
+		plugin.ClientWrite(s, req, resp)
+	}
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// BasePlugin implementation
+//////////////////////////////////////////////////////////////////////////////
+
+func (b BasePlugin) Load() error {
+	return nil
+}
+
+func (b BasePlugin) Register(svc *Service) error {
+	return nil
+}
+
+func (b BasePlugin) Unregister(svc *Service) error {
+	return nil
+}
+
+func (b BasePlugin) Set(svc *Service, key, value string) error {
+	return errors.New(fmt.Sprintf("unknown setting '%s'", key))
+}
+
+func (b BasePlugin) StartRequest(svc *Service, req *http.Request) *http.Response {
+	return nil
+}
+
+func (b BasePlugin) BackendChosen(svc *Service, req *http.Request,
+	be *HttpBackendConnection) {
+}
+
+func (b BasePlugin) BackendResponse(svc *Service, req *http.Request,
+	resp *http.Response) {
+}
+
+func (b BasePlugin) ClientWrite(svc *Service, req *http.Request,
+	resp *http.Response) {
+}
@@ -0,0 +1,164 @@
+/*
+	gobal - plugin_test.go
+
+	Tests for loading plugins and turning them on for services.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// testPlugin writes down what is done to it in testCalls, which is shared by
+// all the test plugins so we can see what order things happen in.
+type testPlugin struct {
+	BasePlugin
+	name   string
+	broken bool
+}
+
+var testCalls []string
+
+func init() {
+	for _, name := range []string{"TestA", "TestB", "TestBroken"} {
+		RegisterPlugin(&testPlugin{name: name, broken: name == "TestBroken"})
+	}
+}
+
+func TestLoadPlugin(t *testing.T) {
+	if err := LoadPlugin("NoSuchPlugin"); err == nil {
+		t.Errorf("loaded a plugin that doesn't exist")
+	}
+	if GetPlugin("NoSuchPlugin") != nil {
+		t.Errorf("got a plugin that doesn't exist")
+	}
+
+	// Names aren't case sensitive, and loading twice is fine.
+	for _, name := range []string{"testa", "TESTA"} {
+		if err := LoadPlugin(name); err != nil {
+			t.Errorf("LOAD %s: %s", name, err)
+		}
+	}
+	if GetPlugin("TestA") == nil {
+		t.Errorf("TestA isn't loaded")
+	}
+}
+
+func TestSetPlugins(t *testing.T) {
+	for _, name := range []string{"TestA", "TestB", "TestBroken"} {
+		if err := LoadPlugin(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &Service{Name: "test"}
+	check := func(what string, plugins string, calls ...string) {
+		var names []string
+		for _, plugin := range s.getPlugins() {
+			names = append(names, plugin.Name())
+		}
+		if strings.Join(names, ", ") != plugins {
+			t.Errorf("%s: plugins are %s; want %s", what, names, plugins)
+		}
+		if strings.Join(testCalls, " ") != strings.Join(calls, " ") {
+			t.Errorf("%s: called %s; want %s", what, testCalls, calls)
+		}
+		testCalls = nil
+	}
+
+	if err := s.Set("plugins", "testb, nosuchplugin"); err == nil {
+		t.Errorf("turned on a plugin that isn't loaded")
+	}
+	check("not loaded", "")
+
+	// A failure part way through undoes what was done, and changes nothing.
+	if err := s.Set("plugins", "testa, testbroken"); err == nil {
+		t.Errorf("registered TestBroken")
+	}
+	check("broken", "", "TestA.Register", "TestA.Unregister")
+
+	if err := s.Set("plugins", "testb, testa"); err != nil {
+		t.Fatal(err)
+	}
+	check("on", "TestB, TestA", "TestB.Register", "TestA.Register")
+
+	// Hooks run in the order the plugins are listed.
+	req, _ := http.NewRequest("GET", "/", nil)
+	if s.runStartRequest(req) != nil {
+		t.Errorf("got a response from StartRequest")
+	}
+	s.runClientWrite(req, HttpSimpleResponse(req, 200, ""))
+	check("hooks", "TestB, TestA", "TestB.StartRequest", "TestA.StartRequest",
+		"TestB.ClientWrite", "TestA.ClientWrite")
+
+	if err := s.Set("plugins", "testa, testb, testbroken"); err == nil {
+		t.Errorf("registered TestBroken")
+	}
+	check("broken again", "TestB, TestA")
+
+	// Reordering registers nothing; dropping one unregisters it.
+	if err := s.Set("plugins", "testa, testb"); err != nil {
+		t.Fatal(err)
+	}
+	check("reorder", "TestA, TestB")
+	if err := s.Set("plugins", "testb"); err != nil {
+		t.Fatal(err)
+	}
+	check("drop", "TestB", "TestA.Unregister")
+
+	// Namespaced settings go to the plugin they name, if it's on.
+	if err := s.Set("TESTB.color", "blue"); err != nil {
+		t.Errorf("SET testb.color: %s", err)
+	}
+	if err := s.Set("testa.color", "blue"); err == nil {
+		t.Errorf("SET testa.color went to a plugin that isn't on")
+	}
+	if err := s.Set("testb.size", "10"); err == nil {
+		t.Errorf("SET testb.size was accepted")
+	}
+	check("set", "TestB", "TestB.Set color=blue", "TestB.Set size=10")
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// testPlugin implementation
+//////////////////////////////////////////////////////////////////////////////
+
+func (p *testPlugin) Name() string {
+	return p.name
+}
+
+func (p *testPlugin) Register(svc *Service) error {
+	if p.broken {
+		return errors.New("broken")
+	}
+	testCalls = append(testCalls, p.name+".Register")
+	return nil
+}
+
+func (p *testPlugin) Unregister(svc *Service) error {
+	testCalls = append(testCalls, p.name+".Unregister")
+	return nil
+}
+
+func (p *testPlugin) Set(svc *Service, key, value string) error {
+	testCalls = append(testCalls, p.name+".Set "+key+"="+value)
+	if key != "color" {
+		return p.BasePlugin.Set(svc, key, value)
+	}
+	return nil
+}
+
+func (p *testPlugin) StartRequest(svc *Service, req *http.Request) *http.Response {
+	testCalls = append(testCalls, p.name+".StartRequest")
+	return nil
+}
+
+func (p *testPlugin) ClientWrite(svc *Service, req *http.Request,
+	resp *http.Response) {
+	testCalls = append(testCalls, p.name+".ClientWrite")
+}
@@ -11,9 +11,13 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"os"
 	"path"
 	"strings"
@@ -25,11 +29,14 @@ import (
 type Backend struct {
 	Ipport string
 
-	// Internal state management variables
+	// Internal state management variables. connectMutex covers connecting,
+	// outstanding and down.
+	pool         *Pool
 	connectMutex sync.Mutex
-	connecting   *HttpBackendConnection
+	connecting   bool
 	outstanding  int
 	generation   int
+	down         bool
 }
 
 // Pool manages a collection of Backends. It is responsible for spawning new
@@ -37,12 +44,38 @@ type Backend struct {
 type Pool struct {
 	Name string
 
+	// TLS to backends
+	BackendSSL    bool
+	sslCAFile     string
+	sslVerify     bool
+	sslServerName string
+	sslCertFile   string
+	sslKeyFile    string
+	tlsConfig     *tls.Config
+
+	// PROXY protocol to backends
+	SendProxy string
+
+	// HTTP/2 to backends
+	Protocol  string
+	muxConns  []*HttpBackendConnection
+	muxNotify chan bool
+
+	// Active health checks
+	HealthCheck    string
+	healthPath     string
+	healthService  string
+	healthInterval time.Duration
+
 	// Internal state management variables
-	backends     []*Backend
-	backendQueue chan *HttpBackendConnection
-	nodeFile     string
-	nodeFileLock sync.Mutex
-	generation   int
+	lock          sync.Mutex
+	backends      []*Backend
+	nextBackend   int
+	backendQueue  chan *HttpBackendConnection
+	nodeFile      string
+	nodeFileLock  sync.Mutex
+	nodeFileMtime time.Time
+	generation    int
 }
 
 var poolLock sync.Mutex
@@ -57,19 +90,92 @@ var pools map[string]*Pool = make(map[string]*Pool)
 func (self *Backend) Connect() {
 	self.connectMutex.Lock()
 	defer self.connectMutex.Unlock()
-	if self.connecting != nil {
+	if self.connecting {
 		return
 	}
+	self.connecting = true
 
 	// If we're here, we want to actually do the connection now.
 	go func() {
+		hconn, err := MakeHttpBackend(self, nil)
+
 		self.connectMutex.Lock()
-		//self.connecting = MakeHttpBackend(self)
+		self.connecting = false
+		if err == nil {
+			self.outstanding++
+		}
 		self.connectMutex.Unlock()
 
+		if err != nil {
+			log.Error("failed to connect to %s: %s", self.Ipport, err)
+			return
+		}
+		if !self.pool.ReleaseBackend(hconn) {
+			hconn.Close()
+		}
 	}()
 }
 
+// Dial makes a new connection to this backend, using TLS if the pool is set
+// up for it. If the pool sends the PROXY protocol, the header is sent first,
+// describing src; connections we make on our own behalf pass nil.
+func (self *Backend) Dial(src ProxySource) (*TcpConnection, error) {
+	cfg, err := self.pool.TlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	version := self.pool.proxyVersion()
+	if cfg != nil && version == "" {
+		return MakeTlsConnection(self.Ipport, cfg)
+	} else if cfg == nil && version == "" {
+		return MakeTcpConnection(self.Ipport)
+	}
+
+	conn, err := net.DialTimeout("tcp", self.Ipport, 3*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if version != "" {
+		if err := WriteProxyHeader(conn, version, src); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if cfg != nil {
+		if conn, err = StartTls(conn, self.Ipport, cfg); err != nil {
+			return nil, err
+		}
+	}
+	return WrapTcpConnection(conn)
+}
+
+// disconnected is called when one of our pooled connections goes away.
+// Connections made for a single client were never counted, so don't call
+// this for those.
+func (self *Backend) disconnected() {
+	self.connectMutex.Lock()
+	defer self.connectMutex.Unlock()
+	if self.outstanding > 0 {
+		self.outstanding--
+	}
+}
+
+// isDown returns true if the backend is failing its health checks.
+func (self *Backend) isDown() bool {
+	self.connectMutex.Lock()
+	defer self.connectMutex.Unlock()
+	return self.down
+}
+
+// setDown marks the backend up or down, returning what it was before.
+func (self *Backend) setDown(down bool) bool {
+	self.connectMutex.Lock()
+	defer self.connectMutex.Unlock()
+	was := self.down
+	self.down = down
+	return was
+}
+
 //////////////////////////////////////////////////////////////////////////////
 // Pool base implementation
 //////////////////////////////////////////////////////////////////////////////
@@ -87,6 +193,12 @@ func NewPool(name string) (*Pool, error) {
 	p := &Pool{
 		Name:         name,
 		backendQueue: make(chan *HttpBackendConnection, 1000),
+		sslVerify:    true,
+		Protocol:     "http/1.1",
+		muxNotify:    make(chan bool, 1),
+
+		healthPath:     "/",
+		healthInterval: 5 * time.Second,
 	}
 	pools[name] = p
 
@@ -94,6 +206,9 @@ func NewPool(name string) (*Pool, error) {
 	// changes to our nodefile, reloading as necessary.
 	go p.updateNodeFileWorker()
 
+	// Health checks run in the background and mark backends up or down.
+	go p.healthCheckWorker()
+
 	// The spawner is a look-ahead backend connector which tries to stay ahead
 	// of estimated traffic by connecting backends ahead of time.
 	//go p.spawner()
@@ -104,78 +219,105 @@ func NewPool(name string) (*Pool, error) {
 // updateNodeFileWorker keeps an eye on the node file this pool uses and, when
 // it changes on disk, reloads it. This manages our backends structure.
 func (p *Pool) updateNodeFileWorker() {
-	p.nodeFileLock.Lock()
-	defer p.nodeFileLock.Unlock()
+	for {
+		time.Sleep(10 * time.Second)
 
-	mtime := time.Unix(0, 0)
+		p.nodeFileLock.Lock()
+		p.loadNodeFile()
+		p.nodeFileLock.Unlock()
+	}
+}
+
+// loadNodeFile checks the node file and, if it has changed since we last
+// looked, updates our backend list. You must hold nodeFileLock.
+func (p *Pool) loadNodeFile() {
+	if p.nodeFile == "" {
+		return
+	}
+
+	fi, err := os.Stat(p.nodeFile)
+	if err != nil {
+		log.Error("failed to stat nodefile: %s", err)
+		return
+	}
+
+	newmtime := fi.ModTime()
+	if !newmtime.After(p.nodeFileMtime) {
+		return
+	}
+
+	p.nodeFileMtime = newmtime
+	newgen := p.generation + 1
+	log.Debug("nodefile changed: %s", p.nodeFile)
+
+	// Load in the nodefile and update our backend list
+	fobj, err := os.Open(p.nodeFile)
+	if err != nil {
+		log.Error("failed to open nodefile: %s", err)
+		return
+	}
+	defer fobj.Close()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	eof := false
+	buf := bufio.NewReader(fobj)
+LINE:
 	for {
-		fi, err := os.Stat(p.nodeFile)
-		if err != nil {
-			log.Error("failed to stat nodefile: %s", err)
-			continue
+		if eof {
+			break
 		}
 
-		newmtime := fi.ModTime()
-		if !newmtime.After(mtime) {
-			continue
+		line, err := buf.ReadString('\n')
+		if err != nil && err != io.EOF {
+			log.Error("failed to read from nodefile: %s", err)
+			return
+		} else if err == io.EOF {
+			eof = true
 		}
 
-		mtime = newmtime
-		newgen := p.generation + 1
-		log.Debug("nodefile changed: %s", p.nodeFile)
-
-		// Load in the nodefile and update our backend list
-		// TODO: Implement :-)
-		fobj, err := os.Open(p.nodeFile)
-		if err != nil {
-			log.Error("failed to open nodefile: %s", err)
+		line = strings.TrimSpace(line)
+		idx := strings.Index(line, "#")
+		if idx > -1 {
+			line = strings.TrimSpace(line[0:idx])
+		}
+		if len(line) < 7 { // At least "1.2.3.4"!
 			continue
 		}
 
-		eof := false
-		buf := bufio.NewReader(fobj)
-	LINE:
-		for {
-			if eof {
-				break
-			}
-
-			line, err := buf.ReadString('\n')
-			if err != nil && err != io.EOF {
-				log.Error("failed to read from nodefile: %s", err)
-				break
-			} else if err == io.EOF {
-				eof = true
-			}
-
-			line = strings.TrimSpace(line)
-			idx := strings.Index(line, "#")
-			if idx > -1 {
-				line = line[0:idx]
-			}
-			if len(line) < 7 { // At least "1.2.3.4"!
-				continue
-			}
-
-			// Refresh an existing structure so we can just keep it and move on.
-			for _, bstruct := range p.backends {
-				if bstruct.Ipport == line {
-					bstruct.generation = newgen
-					continue LINE
-				}
-			}
+		// Port numbers are optional and default to 80.
+		if _, _, err := net.SplitHostPort(line); err != nil {
+			line = net.JoinHostPort(line, "80")
+		}
 
-			// Create a new structure and stick it in our list.
-			bend := &Backend{
-				Ipport:     line,
-				generation: newgen,
+		// Refresh an existing structure so we can just keep it and move on.
+		for _, bstruct := range p.backends {
+			if bstruct.Ipport == line {
+				bstruct.generation = newgen
+				continue LINE
 			}
-			p.backends = append(p.backends, bend)
 		}
 
-		time.Sleep(10 * time.Second)
+		// Create a new structure and stick it in our list.
+		bend := &Backend{
+			Ipport:     line,
+			pool:       p,
+			generation: newgen,
+		}
+		p.backends = append(p.backends, bend)
 	}
 
+	// Anything that wasn't in this version of the file is dropped. Existing
+	// connections to it are allowed to finish.
+	var backends []*Backend
+	for _, bstruct := range p.backends {
+		if bstruct.generation == newgen {
+			backends = append(backends, bstruct)
+		}
+	}
+	p.backends = backends
+	p.generation = newgen
 }
 
 // updateNodeFile reads in the node file and updates it. It also sets up a
@@ -191,25 +333,329 @@ func (p *Pool) updateNodeFile(nodefile string) error {
 	}
 
 	// Now we have to fetch a lock to update the nodefile, so we don't conflict
-	// with the ongoing worker.
+	// with the ongoing worker. Load it right away so that we have backends
+	// before the first request shows up.
 	p.nodeFileLock.Lock()
 	p.nodeFile = nodefile
+	p.nodeFileMtime = time.Unix(0, 0)
+	p.loadNodeFile()
 	p.nodeFileLock.Unlock()
 
 	return nil
 }
 
+// pickBackend chooses the next backend to connect to. We just go round robin,
+// skipping anything that is failing its health checks.
+func (p *Pool) pickBackend() *Backend {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for i := 0; i < len(p.backends); i++ {
+		p.nextBackend = (p.nextBackend + 1) % len(p.backends)
+		if be := p.backends[p.nextBackend]; !be.isDown() {
+			return be
+		}
+	}
+	return nil
+}
+
 // GetBackend returns a handle to a backend. Ideally we return one that is ready
-// to go, but if there are none in the queue, we'll start up a new one.
+// to go, but if there are none in the queue, we'll start up a new one. This
+// returns nil if we couldn't get a backend in a reasonable amount of time.
 func (p *Pool) GetBackend() *HttpBackendConnection {
+	if p.Multiplexed() {
+		return p.getMuxBackend()
+	}
+
+	select {
+	case hconn := <-p.backendQueue:
+		return hconn
+	default:
+	}
+
+	// Nothing idle, so start connecting. If a backend is slow or down, we move
+	// on and try the next one while still waiting for the first.
+	deadline := time.After(10 * time.Second)
+	for {
+		if be := p.pickBackend(); be != nil {
+			be.Connect()
+		}
+
+		select {
+		case hconn := <-p.backendQueue:
+			return hconn
+		case <-time.After(1 * time.Second):
+		case <-deadline:
+			log.Error("pool %s: no backends available", p.Name)
+			return nil
+		}
+	}
+}
+
+// DialBackend makes a new connection to the next backend for a client. If
+// that fails, the others are tried in turn. The connection is never given
+// back to the pool, as it belongs to the client.
+func (p *Pool) DialBackend(src ProxySource) (*Backend, *TcpConnection, error) {
+	p.lock.Lock()
+	tries := len(p.backends)
+	p.lock.Unlock()
+
+	err := errors.New("no backends available")
+	for i := 0; i < tries; i++ {
+		be := p.pickBackend()
+		if be == nil {
+			break
+		}
+
+		var conn *TcpConnection
+		if conn, err = be.Dial(src); err == nil {
+			return be, conn, nil
+		}
+		log.Error("failed to connect to %s: %s", be.Ipport, err)
+	}
+	return nil, nil, err
+}
+
+// GetBackendFor is GetBackend for a particular client. Pools that send the
+// PROXY protocol need a connection made just for that client, which is
+// closed when the request is done. Other pools just use GetBackend.
+func (p *Pool) GetBackendFor(client Client) *HttpBackendConnection {
+	if p.proxyVersion() == "" {
+		return p.GetBackend()
+	}
+
+	p.lock.Lock()
+	tries := len(p.backends)
+	p.lock.Unlock()
+
+	for i := 0; i < tries; i++ {
+		be := p.pickBackend()
+		if be == nil {
+			break
+		}
+
+		hconn, err := MakeHttpBackend(be, client)
+		if err == nil {
+			return hconn
+		}
+		log.Error("failed to connect to %s: %s", be.Ipport, err)
+	}
+	log.Error("pool %s: no backends available", p.Name)
+	return nil
+}
+
+// Multiplexed returns true if this pool speaks HTTP/2 to its backends, in
+// which case connections are shared between requests. The protocol can be
+// changed at any time, so it's read under lock.
+func (p *Pool) Multiplexed() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.Protocol == "h2" || p.Protocol == "h2c"
+}
+
+// getMuxBackend is GetBackend for HTTP/2 pools. Instead of taking a connection
+// off the idle queue, we find a connection that has room for another stream
+// and return a handle on it for this request. New connections are only made
+// when every existing one is at the backend's concurrent stream limit.
+func (p *Pool) getMuxBackend() *HttpBackendConnection {
+	deadline := time.After(10 * time.Second)
+	for {
+		if hconn := p.reserveMux(); hconn != nil {
+			return hconn
+		}
+		if be := p.pickBackend(); be != nil {
+			be.Connect()
+		}
+
+		select {
+		case <-p.muxNotify:
+		case <-time.After(1 * time.Second):
+		case <-deadline:
+			log.Error("pool %s: no backends available", p.Name)
+			return nil
+		}
+	}
+}
+
+// reserveMux reserves a stream on the first connection that can take one.
+// Connections that have gone away are cleaned up while we're looking.
+func (p *Pool) reserveMux() *HttpBackendConnection {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var found *HttpBackendConnection
+	live := p.muxConns[:0]
+	for _, hconn := range p.muxConns {
+		state := hconn.h2.State()
+		if state.Closed || (state.Closing && state.StreamsActive == 0) {
+			hconn.Conn.Close()
+			hconn.Backend.disconnected()
+			continue
+		}
+		live = append(live, hconn)
+
+		if found == nil && !hconn.Backend.isDown() &&
+			hconn.h2.ReserveNewRequest() {
+			found = &HttpBackendConnection{
+				Conn:    hconn.Conn,
+				Backend: hconn.Backend,
+				h2:      hconn.h2,
+			}
+		}
+	}
+	p.muxConns = live
+	return found
+}
+
+// notifyMux wakes up anyone waiting for room on a multiplexed connection.
+func (p *Pool) notifyMux() {
+	select {
+	case p.muxNotify <- true:
+	default:
+	}
+}
+
+// ReleaseBackend puts a connection back in the queue of idle connections.
+// Returns false if the queue is full, in which case the caller should close
+// the connection. Multiplexed connections are kept in their own list.
+func (p *Pool) ReleaseBackend(hconn *HttpBackendConnection) bool {
+	if hconn.h2 != nil {
+		p.lock.Lock()
+		p.muxConns = append(p.muxConns, hconn)
+		p.lock.Unlock()
+		p.notifyMux()
+		return true
+	}
+
+	select {
+	case p.backendQueue <- hconn:
+		return true
+	default:
+		return false
+	}
+}
+
+// TlsConfig returns the configuration to use when connecting to backends,
+// or nil if this pool talks plaintext. This is built on first use so that
+// the settings can be given in any order.
+func (p *Pool) TlsConfig() (*tls.Config, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if !p.BackendSSL && p.Protocol != "h2" {
+		return nil, nil
+	}
+	if p.tlsConfig != nil {
+		return p.tlsConfig, nil
+	}
+
+	cfg := &tls.Config{
+		ServerName:         p.sslServerName,
+		InsecureSkipVerify: !p.sslVerify,
+	}
+	if p.Protocol == "h2" {
+		cfg.NextProtos = []string{"h2"}
+	}
+	if p.sslCAFile != "" {
+		data, err := ioutil.ReadFile(p.sslCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(data) {
+			return nil, errors.New(fmt.Sprintf("%s: no certificates found",
+				p.sslCAFile))
+		}
+	}
+	if p.sslCertFile != "" || p.sslKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(p.sslCertFile, p.sslKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	p.tlsConfig = cfg
+	return cfg, nil
+}
+
+// setTls updates one of the settings for how we connect to backends. The TLS
+// configuration is rebuilt the next time we connect.
+func (p *Pool) setTls(key, value string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var err error
+	backendSSL, verify := p.BackendSSL, p.sslVerify
+	protocol, sendProxy := p.Protocol, p.SendProxy
+	switch key {
+	case "backend_ssl":
+		backendSSL, err = ParseBool(value)
+	case "backend_ssl_verify":
+		verify, err = ParseBool(value)
+	case "backend_ssl_ca_file":
+		p.sslCAFile = path.Clean(strings.TrimSpace(value))
+	case "backend_ssl_server_name":
+		p.sslServerName = strings.TrimSpace(value)
+	case "backend_ssl_cert_file":
+		p.sslCertFile = path.Clean(strings.TrimSpace(value))
+	case "backend_ssl_key_file":
+		p.sslKeyFile = path.Clean(strings.TrimSpace(value))
+	case "backend_protocol":
+		switch value {
+		case "http/1.1", "h2", "h2c":
+			protocol = value
+		default:
+			err = errors.New(fmt.Sprintf("invalid backend_protocol '%s'", value))
+		}
+	case "send_proxy_protocol":
+		switch value {
+		case "off":
+			sendProxy = ""
+		case "v1", "v2":
+			sendProxy = value
+		default:
+			err = errors.New(fmt.Sprintf("invalid send_proxy_protocol '%s'",
+				value))
+		}
+	}
+
+	// A PROXY header describes one client, so those connections can't be
+	// shared by HTTP/2. The pool is left as it was if the two don't go
+	// together.
+	if err == nil && sendProxy != "" && protocol != "http/1.1" {
+		err = errors.New("send_proxy_protocol needs backend_protocol http/1.1")
+	}
+	if err != nil {
+		return err
+	}
+	p.BackendSSL, p.sslVerify = backendSSL, verify
+	p.Protocol, p.SendProxy = protocol, sendProxy
+	p.tlsConfig = nil
 	return nil
 }
 
+// proxyVersion returns the version of the PROXY protocol we send to
+// backends, or "" if we don't. It can be changed at any time, so it's read
+// under lock.
+func (p *Pool) proxyVersion() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.SendProxy
+}
+
 // Set something on a pool.
 func (p *Pool) Set(key, value string) error {
 	switch key {
 	case "nodefile":
 		return p.updateNodeFile(value)
+	case "backend_ssl", "backend_ssl_verify", "backend_ssl_ca_file",
+		"backend_ssl_server_name", "backend_ssl_cert_file",
+		"backend_ssl_key_file", "backend_protocol", "send_proxy_protocol":
+		return p.setTls(key, value)
+	case "health_check", "health_check_path", "health_check_service",
+		"health_check_interval":
+		return p.setHealthCheck(key, value)
 	default:
 		log.Error("unknown SET %s.%s = %s", p.Name, key, value)
 	}
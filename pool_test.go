@@ -0,0 +1,44 @@
+/*
+	gobal - pool_test.go
+
+	Tests for pool settings.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"testing"
+)
+
+func TestPoolSetTlsRejected(t *testing.T) {
+	p := &Pool{Protocol: "http/1.1", BackendSSL: true}
+	if err := p.Set("send_proxy_protocol", "v2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A rejected SET leaves the pool as it was.
+	tests := []struct{ key, value string }{
+		{"backend_protocol", "h2"},
+		{"backend_protocol", "spdy"},
+		{"send_proxy_protocol", "v3"},
+		{"backend_ssl", "maybe"},
+	}
+	for _, test := range tests {
+		if err := p.Set(test.key, test.value); err == nil {
+			t.Errorf("SET %s = %s was accepted", test.key, test.value)
+		}
+		if p.Protocol != "http/1.1" || p.SendProxy != "v2" || !p.BackendSSL {
+			t.Errorf("SET %s = %s left %s, %s, %v", test.key, test.value,
+				p.Protocol, p.SendProxy, p.BackendSSL)
+		}
+	}
+
+	if err := p.Set("send_proxy_protocol", "off"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Set("backend_protocol", "h2"); err != nil || !p.Multiplexed() {
+		t.Errorf("backend_protocol h2: %v", err)
+	}
+}
@@ -0,0 +1,269 @@
+/*
+	gobal - proxy_protocol.go
+
+	The PROXY protocol, versions 1 and 2, as used by TCP load balancers to
+	tell us who the client really is. The header is sent before anything
+	else on the connection.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PROXY_V2_SIGNATURE starts every version 2 header.
+const PROXY_V2_SIGNATURE = "\r\n\r\n\x00\r\nQUIT\n"
+
+// ProxySource is anything that knows both ends of a client's connection, which
+// is what goes into a PROXY header. Both net.Conn and Client will do.
+type ProxySource interface {
+	RemoteAddr() net.Addr
+	LocalAddr() net.Addr
+}
+
+// proxiedConn is a connection that came to us through a proxy. The addresses
+// are the ones the proxy told us about, rather than the proxy's own.
+type proxiedConn struct {
+	bufferedConn
+	remote net.Addr
+	local  net.Addr
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// Reading PROXY headers
+//////////////////////////////////////////////////////////////////////////////
+
+// ReadProxyHeader reads the PROXY header from the start of a connection and
+// returns a connection that reports the addresses from the header. If the
+// header says the proxy is talking to us on its own behalf, such as for a
+// health check, the addresses are left alone.
+func ReadProxyHeader(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+
+	// Both versions are longer than the v2 signature, so this is safe.
+	rdr := bufio.NewReader(conn)
+	sig, err := rdr.Peek(len(PROXY_V2_SIGNATURE))
+	if err != nil {
+		return nil, err
+	}
+
+	var remote, local net.Addr
+	if string(sig) == PROXY_V2_SIGNATURE {
+		remote, local, err = readProxyV2(rdr)
+	} else if string(sig[0:6]) == "PROXY " {
+		remote, local, err = readProxyV1(rdr)
+	} else {
+		err = errors.New("missing PROXY header")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	pconn := &proxiedConn{
+		bufferedConn: bufferedConn{conn, rdr},
+		remote:       remote,
+		local:        local,
+	}
+	if remote == nil {
+		pconn.remote, pconn.local = conn.RemoteAddr(), conn.LocalAddr()
+	}
+	return pconn, nil
+}
+
+// readProxyV1 reads a text header, something like:
+//
+//	PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n
+func readProxyV1(rdr *bufio.Reader) (net.Addr, net.Addr, error) {
+	// The longest valid header is 107 bytes. Don't read forever.
+	var line []byte
+	for len(line) < 107 {
+		c, err := rdr.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("PROXY header too long")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, errors.New(fmt.Sprintf("invalid PROXY header '%s'",
+			line[:len(line)-2]))
+	}
+
+	remote, err := parseProxyAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	local, err := parseProxyAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return remote, local, nil
+}
+
+// parseProxyAddr turns an address and port from a text header into a TCPAddr.
+func parseProxyAddr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, errors.New(fmt.Sprintf("invalid PROXY address '%s'", host))
+	}
+	pnum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid PROXY port '%s'", port))
+	}
+	return &net.TCPAddr{IP: ip, Port: int(pnum)}, nil
+}
+
+// readProxyV2 reads a binary header. We only care about TCP over IPv4 and
+// IPv6; anything else is accepted, but the addresses are left alone.
+func readProxyV2(rdr *bufio.Reader) (net.Addr, net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(rdr, hdr[:]); err != nil {
+		return nil, nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, nil, errors.New(fmt.Sprintf("unsupported PROXY version %d",
+			hdr[12]>>4))
+	}
+
+	data := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(rdr, data); err != nil {
+		return nil, nil, err
+	}
+
+	// The LOCAL command is the proxy speaking for itself.
+	switch hdr[12] & 0xf {
+	case 0:
+		return nil, nil, nil
+	case 1:
+	default:
+		return nil, nil, errors.New(fmt.Sprintf("unsupported PROXY command %d",
+			hdr[12]&0xf))
+	}
+
+	// Anything after the addresses is TLVs, which we don't need.
+	var size int
+	switch hdr[13] {
+	case 0x11:
+		size = net.IPv4len
+	case 0x21:
+		size = net.IPv6len
+	default:
+		return nil, nil, nil
+	}
+	if len(data) < 2*size+4 {
+		return nil, nil, errors.New("PROXY header too short")
+	}
+	remote := &net.TCPAddr{
+		IP:   net.IP(append([]byte{}, data[0:size]...)),
+		Port: int(binary.BigEndian.Uint16(data[2*size:])),
+	}
+	local := &net.TCPAddr{
+		IP:   net.IP(append([]byte{}, data[size:2*size]...)),
+		Port: int(binary.BigEndian.Uint16(data[2*size+2:])),
+	}
+	return remote, local, nil
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// Writing PROXY headers
+//////////////////////////////////////////////////////////////////////////////
+
+// WriteProxyHeader sends a PROXY header of the given version ("v1" or "v2")
+// for a client. If there's no client, or we can't describe its addresses,
+// the header says that we're connecting on our own behalf.
+func WriteProxyHeader(w io.Writer, version string, src ProxySource) error {
+	var remote, local *net.TCPAddr
+	if src != nil {
+		remote, _ = src.RemoteAddr().(*net.TCPAddr)
+		local, _ = src.LocalAddr().(*net.TCPAddr)
+	}
+
+	// Both ends have to be the same family.
+	if remote != nil && local != nil {
+		if (remote.IP.To4() == nil) != (local.IP.To4() == nil) {
+			remote, local = nil, nil
+		}
+	}
+
+	var hdr []byte
+	if version == "v2" {
+		hdr = proxyHeaderV2(remote, local)
+	} else {
+		hdr = proxyHeaderV1(remote, local)
+	}
+	_, err := w.Write(hdr)
+	return err
+}
+
+// proxyHeaderV1 builds a text header.
+func proxyHeaderV1(remote, local *net.TCPAddr) []byte {
+	if remote == nil || local == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	family := "TCP6"
+	if remote.IP.To4() != nil {
+		family = "TCP4"
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family,
+		remote.IP, local.IP, remote.Port, local.Port))
+}
+
+// proxyHeaderV2 builds a binary header.
+func proxyHeaderV2(remote, local *net.TCPAddr) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(PROXY_V2_SIGNATURE)
+	if remote == nil || local == nil {
+		// LOCAL command, no addresses.
+		buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return buf.Bytes()
+	}
+
+	family, rip, lip := byte(0x21), remote.IP.To16(), local.IP.To16()
+	if remote.IP.To4() != nil {
+		family, rip, lip = 0x11, remote.IP.To4(), local.IP.To4()
+	}
+	buf.Write([]byte{0x21, family})
+	binary.Write(&buf, binary.BigEndian, uint16(2*len(rip)+4))
+	buf.Write(rip)
+	buf.Write(lip)
+	binary.Write(&buf, binary.BigEndian, uint16(remote.Port))
+	binary.Write(&buf, binary.BigEndian, uint16(local.Port))
+	return buf.Bytes()
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// proxiedConn implementation
+//////////////////////////////////////////////////////////////////////////////
+
+// RemoteAddr is the client's address, as given by the proxy.
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// LocalAddr is the address the client connected to, as given by the proxy.
+func (c *proxiedConn) LocalAddr() net.Addr {
+	return c.local
+}
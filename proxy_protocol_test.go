@@ -0,0 +1,251 @@
+/*
+	gobal - proxy_protocol_test.go
+
+	Tests for reading and writing PROXY protocol headers.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestReadProxyV1(t *testing.T) {
+	tests := []struct {
+		line   string
+		remote string
+		local  string
+		ok     bool
+	}{
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n",
+			"192.0.2.1:56324", "198.51.100.1:443", true},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n",
+			"[2001:db8::1]:56324", "[2001:db8::2]:443", true},
+
+		// The proxy speaking for itself leaves the addresses alone.
+		{"PROXY UNKNOWN\r\n", "", "", true},
+		{"PROXY UNKNOWN 192.0.2.1 198.51.100.1 56324 443\r\n", "", "", true},
+
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n", "", "", false},
+		{"PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n", "", "", false},
+		{"PROXY TCP4 192.0.2.x 198.51.100.1 56324 443\r\n", "", "", false},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 99999\r\n", "", "", false},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n", "", "", false},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443", "", "", false},
+		{"PROXY " + strings.Repeat("x", 200) + "\r\n", "", "", false},
+	}
+
+	for _, test := range tests {
+		remote, local, err := readProxyV1(bufio.NewReader(
+			strings.NewReader(test.line)))
+		if (err == nil) != test.ok {
+			t.Errorf("%q: error %v; want ok %v", test.line, err, test.ok)
+			continue
+		}
+		if !test.ok {
+			continue
+		}
+		if addrString(remote) != test.remote || addrString(local) != test.local {
+			t.Errorf("%q: got %v, %v; want %s, %s", test.line, remote, local,
+				test.remote, test.local)
+		}
+	}
+}
+
+func TestProxyV2RoundTrip(t *testing.T) {
+	tests := []struct {
+		remote string
+		local  string
+	}{
+		{"192.0.2.1:56324", "198.51.100.1:443"},
+		{"[2001:db8::1]:56324", "[2001:db8::2]:443"},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		var remote, local *net.TCPAddr
+		if test.remote != "" {
+			remote, _ = net.ResolveTCPAddr("tcp", test.remote)
+			local, _ = net.ResolveTCPAddr("tcp", test.local)
+		}
+		hdr := proxyHeaderV2(remote, local)
+		if !bytes.HasPrefix(hdr, []byte(PROXY_V2_SIGNATURE)) {
+			t.Errorf("%s: header %x has no signature", test.remote, hdr)
+			continue
+		}
+
+		r, l, err := readProxyV2(bufio.NewReader(bytes.NewReader(hdr)))
+		if err != nil {
+			t.Errorf("%s: %s", test.remote, err)
+			continue
+		}
+		if addrString(r) != test.remote || addrString(l) != test.local {
+			t.Errorf("got %v, %v; want %s, %s", r, l, test.remote, test.local)
+		}
+	}
+}
+
+func TestReadProxyV2Errors(t *testing.T) {
+	v4 := proxyHeaderV2(&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1},
+		&net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 2})
+
+	badVersion := append([]byte{}, v4...)
+	badVersion[12] = 0x11
+	badCommand := append([]byte{}, v4...)
+	badCommand[12] = 0x22
+	short := append([]byte{}, v4[:16]...)
+	short[15] = 4
+	short = append(short, 1, 2, 3, 4)
+
+	tests := []struct {
+		name string
+		hdr  []byte
+	}{
+		{"truncated", v4[:len(v4)-1]},
+		{"version 1", badVersion},
+		{"command 2", badCommand},
+		{"addresses too short", short},
+	}
+
+	for _, test := range tests {
+		if r, l, err := readProxyV2(bufio.NewReader(
+			bytes.NewReader(test.hdr))); err == nil {
+			t.Errorf("%s: got %v, %v; want an error", test.name, r, l)
+		}
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	tests := []string{
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n",
+		string(proxyHeaderV2(
+			&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 56324},
+			&net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 443})),
+	}
+
+	for _, hdr := range tests {
+		client, server := net.Pipe()
+		go func() {
+			client.Write([]byte(hdr + "GET / HTTP/1.1\r\n"))
+			client.Close()
+		}()
+
+		conn, err := ReadProxyHeader(server)
+		if err != nil {
+			t.Errorf("%q: %s", hdr, err)
+			continue
+		}
+		if got := conn.RemoteAddr().String(); got != "192.0.2.1:56324" {
+			t.Errorf("%q: remote %s", hdr, got)
+		}
+		if got := conn.LocalAddr().String(); got != "198.51.100.1:443" {
+			t.Errorf("%q: local %s", hdr, got)
+		}
+
+		// Whatever came after the header is still there to be read.
+		rest, _ := ioutil.ReadAll(conn)
+		if string(rest) != "GET / HTTP/1.1\r\n" {
+			t.Errorf("%q: left %q", hdr, rest)
+		}
+		conn.Close()
+	}
+
+	client, server := net.Pipe()
+	go func() {
+		client.Write([]byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n"))
+		client.Close()
+	}()
+	if _, err := ReadProxyHeader(server); err == nil {
+		t.Errorf("request without a header was accepted")
+	}
+	server.Close()
+}
+
+func TestWriteProxyHeaderV1(t *testing.T) {
+	remote := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 56324}
+	local := &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 443}
+	if got := string(proxyHeaderV1(remote, local)); got !=
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n" {
+		t.Errorf("got %q", got)
+	}
+	if got := string(proxyHeaderV1(nil, nil)); got != "PROXY UNKNOWN\r\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+// addrString is an address as a string, or "" for none.
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+// proxySource is a ProxySource with whatever addresses a test wants.
+type proxySource struct {
+	remote, local net.Addr
+}
+
+func (s proxySource) RemoteAddr() net.Addr { return s.remote }
+func (s proxySource) LocalAddr() net.Addr  { return s.local }
+
+func TestWriteProxyHeader(t *testing.T) {
+	v4 := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 56324}
+	v4local := &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 443}
+	v6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+	v6local := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+	unix := &net.UnixAddr{Name: "/tmp/gobal.sock", Net: "unix"}
+
+	// Anything we can't describe reads back as the connection's own
+	// addresses, which for a pipe are "pipe".
+	tests := []struct {
+		name   string
+		src    ProxySource
+		remote string
+		local  string
+	}{
+		{"IPv4", proxySource{v4, v4local}, v4.String(), v4local.String()},
+		{"IPv6", proxySource{v6, v6local}, v6.String(), v6local.String()},
+		{"no source", nil, "pipe", "pipe"},
+		{"IPv4 to IPv6", proxySource{v4, v6local}, "pipe", "pipe"},
+		{"IPv6 to IPv4", proxySource{v6, v4local}, "pipe", "pipe"},
+		{"unix socket", proxySource{unix, unix}, "pipe", "pipe"},
+	}
+
+	for _, version := range []string{"v1", "v2"} {
+		for _, test := range tests {
+			client, server := net.Pipe()
+			go func() {
+				if err := WriteProxyHeader(client, version, test.src); err != nil {
+					t.Errorf("%s %s: %s", version, test.name, err)
+				}
+				client.Write([]byte("GET / HTTP/1.1\r\n"))
+				client.Close()
+			}()
+
+			conn, err := ReadProxyHeader(server)
+			if err != nil {
+				t.Errorf("%s %s: %s", version, test.name, err)
+				server.Close()
+				continue
+			}
+			if conn.RemoteAddr().String() != test.remote ||
+				conn.LocalAddr().String() != test.local {
+				t.Errorf("%s %s: got %s, %s; want %s, %s", version, test.name,
+					conn.RemoteAddr(), conn.LocalAddr(), test.remote, test.local)
+			}
+			rest, _ := ioutil.ReadAll(conn)
+			if string(rest) != "GET / HTTP/1.1\r\n" {
+				t.Errorf("%s %s: left %q", version, test.name, rest)
+			}
+			conn.Close()
+		}
+	}
+}
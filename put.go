@@ -0,0 +1,262 @@
+/*
+	gobal - put.go
+
+	Changing files through the web server role, so things like build systems
+	can upload straight to us. PUT writes a file and DELETE removes one; both
+	have to be turned on, and only clients from write_allow may use them.
+
+	An upload goes to a temporary file next to where it's going, which is
+	renamed into place once we have all of it. Nobody ever sees half a file.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// errPutDirectory means a PUT wanted to make directories that it's not
+// allowed to. See min_put_directory.
+var errPutDirectory = errors.New("directory must already exist")
+
+//////////////////////////////////////////////////////////////////////////////
+// Changing files
+//////////////////////////////////////////////////////////////////////////////
+
+// allowedMethods is the Allow header for the files we serve.
+func (s *Service) allowedMethods() string {
+	methods := []string{"GET", "HEAD"}
+	if s.EnablePut {
+		methods = append(methods, "PUT")
+	}
+	if s.EnableDelete {
+		methods = append(methods, "DELETE")
+	}
+	return strings.Join(methods, ", ")
+}
+
+// changeFile handles a PUT or DELETE, which must be turned on before we get
+// here. The client has to be one that write_allow lets change things; with no
+// write_allow, nobody can.
+func (s *Service) changeFile(req ServiceRequest) {
+	if s.writeAllow == nil || !s.writeAllow.Contains(req.client.RemoteAddr()) {
+		s.Stats.Add("webserver.write_denied", 1)
+		s.respond(req, refuseChange(req.request,
+			HttpSimpleResponse(req.request, 403, "Forbidden")))
+		return
+	}
+
+	filepath, err := CleanPath(s.DocRoot, req.request.URL.Path)
+	if err != nil || filepath == s.DocRoot ||
+		strings.HasSuffix(req.request.URL.Path, "/") {
+		s.respond(req, refuseChange(req.request,
+			HttpSimpleResponse(req.request, 403, "Forbidden")))
+		return
+	}
+
+	if req.request.Method == "PUT" {
+		s.putFile(req, filepath)
+	} else {
+		s.deleteFile(req, filepath)
+	}
+}
+
+// putFile writes the body of a request to a file, replacing whatever was
+// there. Answers 201 for a new file and 204 for one that's been replaced.
+func (s *Service) putFile(req ServiceRequest, filepath string) {
+	if s.MaxPutSize > 0 && req.request.ContentLength > s.MaxPutSize {
+		s.Stats.Add("webserver.put_too_large", 1)
+		s.respond(req, UploadTooLargeResponse(req.request))
+		return
+	}
+
+	status := putStatus(filepath)
+	if status == 0 {
+		s.respond(req, refuseChange(req.request,
+			HttpSimpleResponse(req.request, 409, "Can't replace a directory")))
+		return
+	}
+
+	dir := path.Dir(filepath)
+	if err := s.makePutDirectory(dir); err == errPutDirectory {
+		s.respond(req, refuseChange(req.request,
+			HttpSimpleResponse(req.request, 403, "Forbidden")))
+		return
+	} else if err != nil {
+		s.respond(req, refuseChange(req.request,
+			FileErrorResponse(req.request, err)))
+		return
+	}
+
+	// The temporary file is a dotfile, so it stays out of listings.
+	f, err := ioutil.TempFile(dir, ".put-")
+	if err != nil {
+		log.Error("putFile(%s): %s", filepath, err)
+		s.respond(req, refuseChange(req.request,
+			FileErrorResponse(req.request, err)))
+		return
+	}
+	tmpname := f.Name()
+
+	progress := s.trackUpload(req)
+	var rdr io.Reader = &progressReader{req.request.Body, progress}
+	if s.MaxPutSize > 0 {
+		// One byte more than we're allowed, so we know if it's too big.
+		rdr = io.LimitReader(rdr, s.MaxPutSize+1)
+	}
+	n, err := io.Copy(f, rdr)
+	progress.Done()
+
+	// Closing the body reads whatever is left of it, which we don't want to
+	// do for one that's too big.
+	if err == nil && s.MaxPutSize > 0 && n > s.MaxPutSize {
+		err = errUploadTooLarge
+	} else {
+		req.request.Body.Close()
+	}
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpname, filepath)
+	}
+	if err != nil {
+		os.Remove(tmpname)
+		if err == errUploadTooLarge {
+			s.Stats.Add("webserver.put_too_large", 1)
+			s.respond(req, UploadTooLargeResponse(req.request))
+			return
+		}
+		log.Error("putFile(%s): %s", filepath, err)
+		s.respond(req, FileErrorResponse(req.request, err))
+		return
+	}
+
+	s.files.Forget(filepath)
+	s.Stats.Add("webserver.put", 1)
+	if status == 201 {
+		s.respond(req, HttpSimpleResponse(req.request, 201, "Created"))
+	} else {
+		s.respond(req, HttpSimpleResponse(req.request, 204, ""))
+	}
+}
+
+// deleteFile removes a file. Directories are left alone.
+func (s *Service) deleteFile(req ServiceRequest, filepath string) {
+	fi, err := os.Lstat(filepath)
+	if err != nil {
+		s.respond(req, FileErrorResponse(req.request, err))
+		return
+	}
+	if fi.IsDir() {
+		s.respond(req, HttpSimpleResponse(req.request, 409,
+			"Can't delete a directory"))
+		return
+	}
+
+	// The file itself may be a symlink, which just removes the link, but a
+	// symlinked directory could take us anywhere.
+	if !RealInsideRoot(s.DocRoot, path.Dir(filepath)) {
+		s.respond(req, HttpSimpleResponse(req.request, 403, "Forbidden"))
+		return
+	}
+
+	if err := os.Remove(filepath); err != nil {
+		log.Error("deleteFile(%s): %s", filepath, err)
+		s.respond(req, FileErrorResponse(req.request, err))
+		return
+	}
+
+	s.files.Forget(filepath)
+	s.Stats.Add("webserver.delete", 1)
+	s.respond(req, HttpSimpleResponse(req.request, 204, ""))
+}
+
+// makePutDirectory makes sure the directory a file is being put in exists.
+// The first min_put_directory levels under the docroot have to be there
+// already; anything deeper is made as needed.
+func (s *Service) makePutDirectory(dir string) error {
+	if !InsideRoot(s.DocRoot, dir) {
+		return errPutDirectory
+	}
+	var parts []string
+	if rel := strings.Trim(dir[len(s.DocRoot):], "/"); rel != "" {
+		parts = strings.Split(rel, "/")
+	}
+	if len(parts) < s.MinPutDir {
+		return errPutDirectory
+	}
+
+	required := path.Join(append([]string{s.DocRoot}, parts[:s.MinPutDir]...)...)
+	fi, err := os.Stat(required)
+	if err != nil || !fi.IsDir() {
+		return errPutDirectory
+	}
+
+	// The path is only checked as a string so far, and a symlinked directory
+	// would take the upload somewhere else.
+	if !RealInsideRoot(s.DocRoot, dir) {
+		return errPutDirectory
+	}
+	return os.MkdirAll(dir, 0755)
+}
+
+// RealInsideRoot is InsideRoot for what's on disk: symlinks along dir and in
+// root are followed first. The end of dir that doesn't exist yet is taken as
+// it is, since we're about to make it.
+func RealInsideRoot(root, dir string) bool {
+	root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return false
+	}
+
+	rest := ""
+	for {
+		real, err := filepath.EvalSymlinks(dir)
+		if err == nil {
+			return InsideRoot(root, path.Join(real, rest))
+		}
+
+		// A dangling symlink doesn't exist either, but it's not something we
+		// can make a directory in place of.
+		if _, lerr := os.Lstat(dir); !os.IsNotExist(err) || lerr == nil ||
+			dir == path.Dir(dir) {
+			return false
+		}
+		rest = path.Join(path.Base(dir), rest)
+		dir = path.Dir(dir)
+	}
+}
+
+// refuseChange is for answering a PUT or DELETE that we won't do. If it had
+// a body, we haven't read it, so the connection is closed afterwards rather
+// than reading the body as the next request.
+func refuseChange(req *http.Request, resp *http.Response) *http.Response {
+	resp.Close = HasBody(req)
+	return resp
+}
+
+// putStatus is the status for a PUT to a file: 201 if it's new, 204 if it's
+// being replaced, or 0 if it's a directory and can't be.
+func putStatus(filepath string) int {
+	fi, err := os.Stat(filepath)
+	switch {
+	case err != nil:
+		return 201
+	case fi.IsDir():
+		return 0
+	}
+	return 204
+}
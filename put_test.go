@@ -0,0 +1,69 @@
+/*
+	gobal - put_test.go
+
+	Tests for keeping PUT and DELETE inside the docroot.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestRealInsideRoot(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gobal-put-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	root := path.Join(tmp, "www")
+	outside := path.Join(tmp, "outside")
+	for _, dir := range []string{root + "/a", outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		root + "/out":      outside,
+		root + "/in":       root + "/a",
+		root + "/dangling": tmp + "/nothing",
+		tmp + "/link":      root,
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		root, dir string
+		inside    bool
+	}{
+		{root, root, true},
+		{root, root + "/a", true},
+		{root, root + "/a/new/deeper", true},
+		{root, root + "/in/new", true},
+
+		// A symlinked docroot is fine, as long as what's in it stays there.
+		{tmp + "/link", tmp + "/link/a", true},
+		{tmp + "/link", tmp + "/link/out", false},
+
+		{root, root + "/out", false},
+		{root, root + "/out/new", false},
+		{root, root + "/dangling", false},
+		{root, root + "/dangling/new", false},
+		{root + "/missing", root + "/missing/a", false},
+	}
+
+	for _, test := range tests {
+		if got := RealInsideRoot(test.root, test.dir); got != test.inside {
+			t.Errorf("RealInsideRoot(%q, %q) = %v", test.root, test.dir, got)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+/*
+	gobal - ranges.go
+
+	Conditional and range requests for the files we serve. Clients that have
+	a copy can check it's still good with If-Modified-Since or If-None-Match,
+	and clients that have part of a file can ask for the rest with Range.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MAX_RANGES is how many ranges we'll send in one response. Clients asking
+// for more than that get the whole file instead.
+const MAX_RANGES = 32
+
+// errRangeUnsatisfiable means none of the ranges asked for are in the file.
+var errRangeUnsatisfiable = errors.New("range not satisfiable")
+
+// byteRange is part of a file, from start for length bytes.
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// Conditional requests
+//////////////////////////////////////////////////////////////////////////////
+
+// FileEtag makes an entity tag for a file out of when it was modified and how
+// big it is. That's enough to notice it changing without reading it.
+func FileEtag(fi os.FileInfo) string {
+	return fmt.Sprintf("\"%x-%x\"", fi.ModTime().UnixNano(), fi.Size())
+}
+
+// checkConditions looks at the conditional headers in a request for a file.
+// It returns the status to answer with if a condition says not to send the
+// file, such as 304, or 0 to carry on.
+func checkConditions(req *http.Request, modtime time.Time, etag string) int {
+	// HTTP dates don't have anything smaller than a second.
+	modtime = modtime.Truncate(time.Second)
+
+	if match := req.Header.Get("If-Match"); match != "" {
+		if !etagMatches(match, etag, false) {
+			return http.StatusPreconditionFailed
+		}
+	} else if since, err := http.ParseTime(req.Header.Get(
+		"If-Unmodified-Since")); err == nil && modtime.After(since) {
+		return http.StatusPreconditionFailed
+	}
+
+	if match := req.Header.Get("If-None-Match"); match != "" {
+		if etagMatches(match, etag, true) {
+			return http.StatusNotModified
+		}
+	} else if since, err := http.ParseTime(req.Header.Get(
+		"If-Modified-Since")); err == nil && !modtime.After(since) {
+		return http.StatusNotModified
+	}
+	return 0
+}
+
+// etagMatches checks an entity tag against a list of them from a header. Weak
+// comparison ignores the W/ that marks weak tags; strong comparison says weak
+// tags never match.
+func etagMatches(list, etag string, weak bool) bool {
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		if strings.HasPrefix(tag, "W/") {
+			if !weak {
+				continue
+			}
+			tag = tag[2:]
+		}
+		if tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// ifRangeMatches returns true if the ranges in a request should be sent. If
+// the client's copy is out of date, it gets the whole file instead.
+func ifRangeMatches(req *http.Request, modtime time.Time, etag string) bool {
+	cond := strings.TrimSpace(req.Header.Get("If-Range"))
+	if cond == "" {
+		return true
+	}
+	if strings.HasPrefix(cond, "\"") {
+		return cond == etag
+	}
+	date, err := http.ParseTime(cond)
+	return err == nil && date.Equal(modtime.Truncate(time.Second))
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// Range requests
+//////////////////////////////////////////////////////////////////////////////
+
+// parseRange reads a Range header for a file of the given size. If there's
+// nothing we understand, or it's not worth doing, there are no ranges and the
+// whole file should be sent.
+func parseRange(value string, size int64) ([]byteRange, error) {
+	if !strings.HasPrefix(value, "bytes=") {
+		return nil, nil
+	}
+
+	var ranges []byteRange
+	var total int64
+	for _, spec := range strings.Split(value[6:], ",") {
+		spec = strings.TrimSpace(spec)
+		dash := strings.Index(spec, "-")
+		if dash < 0 {
+			return nil, nil
+		}
+		first, last := spec[:dash], spec[dash+1:]
+
+		var r byteRange
+		if first == "" {
+			// The last N bytes.
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, nil
+			}
+			if n == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			r = byteRange{size - n, n}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, nil
+			}
+			end := size - 1
+			if last != "" {
+				if end, err = strconv.ParseInt(last, 10, 64); err != nil ||
+					end < start {
+					return nil, nil
+				}
+				if end >= size {
+					end = size - 1
+				}
+			}
+			if start >= size {
+				continue
+			}
+			r = byteRange{start, end - start + 1}
+		}
+		ranges = append(ranges, r)
+		total += r.length
+	}
+
+	if len(ranges) == 0 {
+		return nil, errRangeUnsatisfiable
+	}
+	// Lots of little or overlapping ranges cost more than the whole file.
+	if len(ranges) > MAX_RANGES || total > size {
+		return nil, nil
+	}
+	return ranges, nil
+}
+
+// contentRange is the Content-Range header for part of a file.
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// multipartRanges builds a multipart/byteranges body out of several parts of
+// a file. Returns the body, its length and its content type.
+func multipartRanges(f *os.File, ranges []byteRange, size int64,
+	ctype string) (io.Reader, int64, string) {
+	var b [16]byte
+	rand.Read(b[:])
+	boundary := hex.EncodeToString(b[:])
+
+	var parts []io.Reader
+	var length int64
+	for _, r := range ranges {
+		hdr := fmt.Sprintf("\r\n--%s\r\nContent-Type: %s\r\n"+
+			"Content-Range: %s\r\n\r\n", boundary, ctype, r.contentRange(size))
+		parts = append(parts, strings.NewReader(hdr),
+			io.NewSectionReader(f, r.start, r.length))
+		length += int64(len(hdr)) + r.length
+	}
+	end := fmt.Sprintf("\r\n--%s--\r\n", boundary)
+	parts = append(parts, strings.NewReader(end))
+	length += int64(len(end))
+
+	return io.MultiReader(parts...), length,
+		"multipart/byteranges; boundary=" + boundary
+}
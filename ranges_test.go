@@ -0,0 +1,166 @@
+/*
+	gobal - ranges_test.go
+
+	Tests for Range headers and conditional requests.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRange(t *testing.T) {
+	many := "bytes=" + strings.Repeat("0-0,", MAX_RANGES) + "0-0"
+
+	tests := []struct {
+		value  string
+		size   int64
+		ranges []byteRange
+		err    error
+	}{
+		// Nothing we understand means the whole file.
+		{"", 100, nil, nil},
+		{"items=0-9", 100, nil, nil},
+		{"bytes=abc", 100, nil, nil},
+		{"bytes=5-2", 100, nil, nil},
+		{"bytes=-x", 100, nil, nil},
+
+		{"bytes=0-9", 100, []byteRange{{0, 10}}, nil},
+		{"bytes=90-", 100, []byteRange{{90, 10}}, nil},
+		{"bytes=95-200", 100, []byteRange{{95, 5}}, nil},
+		{"bytes=0-9, 20-29", 100, []byteRange{{0, 10}, {20, 10}}, nil},
+
+		// Suffixes are the last N bytes, or all of them if N is bigger.
+		{"bytes=-10", 100, []byteRange{{90, 10}}, nil},
+		{"bytes=-200", 100, []byteRange{{0, 100}}, nil},
+
+		// Overlaps that add up to more than the file get the whole file, as
+		// do too many ranges.
+		{"bytes=0-59,40-99", 100, nil, nil},
+		{"bytes=0-,-1", 100, nil, nil},
+		{"bytes=0-9,5-14", 100, []byteRange{{0, 10}, {5, 10}}, nil},
+		{many, 100, nil, nil},
+
+		// Ranges past the end are dropped, and if that's all of them, the
+		// request can't be satisfied.
+		{"bytes=0-9,200-", 100, []byteRange{{0, 10}}, nil},
+		{"bytes=100-", 100, nil, errRangeUnsatisfiable},
+		{"bytes=200-300,150-", 100, nil, errRangeUnsatisfiable},
+		{"bytes=-0", 100, nil, errRangeUnsatisfiable},
+		{"bytes=0-", 0, nil, errRangeUnsatisfiable},
+	}
+
+	for _, test := range tests {
+		ranges, err := parseRange(test.value, test.size)
+		if err != test.err || !reflect.DeepEqual(ranges, test.ranges) {
+			t.Errorf("parseRange(%q, %d) = %v, %v; want %v, %v", test.value,
+				test.size, ranges, err, test.ranges, test.err)
+		}
+	}
+}
+
+func TestContentRange(t *testing.T) {
+	if got := (byteRange{90, 10}).contentRange(100); got != "bytes 90-99/100" {
+		t.Errorf("contentRange = %q", got)
+	}
+}
+
+func TestCheckConditions(t *testing.T) {
+	modtime := time.Date(2013, 5, 1, 12, 0, 0, 500, time.UTC)
+	etag := "\"abc\""
+	at := func(d time.Duration) string {
+		return modtime.Add(d).Format(http.TimeFormat)
+	}
+
+	tests := []struct {
+		header map[string]string
+		status int
+	}{
+		{nil, 0},
+
+		{map[string]string{"If-None-Match": "\"abc\""}, 304},
+		{map[string]string{"If-None-Match": "W/\"abc\""}, 304},
+		{map[string]string{"If-None-Match": "\"x\", \"abc\""}, 304},
+		{map[string]string{"If-None-Match": "*"}, 304},
+		{map[string]string{"If-None-Match": "\"x\""}, 0},
+
+		// Modification times are only good to the second.
+		{map[string]string{"If-Modified-Since": at(0)}, 304},
+		{map[string]string{"If-Modified-Since": at(time.Hour)}, 304},
+		{map[string]string{"If-Modified-Since": at(-time.Second)}, 0},
+		{map[string]string{"If-Modified-Since": "yesterday"}, 0},
+
+		// If-None-Match wins over If-Modified-Since.
+		{map[string]string{
+			"If-None-Match":     "\"x\"",
+			"If-Modified-Since": at(time.Hour),
+		}, 0},
+
+		// If-Match only takes strong tags.
+		{map[string]string{"If-Match": "\"abc\""}, 0},
+		{map[string]string{"If-Match": "*"}, 0},
+		{map[string]string{"If-Match": "W/\"abc\""}, 412},
+		{map[string]string{"If-Match": "\"x\""}, 412},
+
+		{map[string]string{"If-Unmodified-Since": at(0)}, 0},
+		{map[string]string{"If-Unmodified-Since": at(-time.Second)}, 412},
+
+		// If-Match wins over If-Unmodified-Since.
+		{map[string]string{
+			"If-Match":            "\"abc\"",
+			"If-Unmodified-Since": at(-time.Hour),
+		}, 0},
+
+		// Failed preconditions come before not modified.
+		{map[string]string{
+			"If-Match":      "\"x\"",
+			"If-None-Match": "\"abc\"",
+		}, 412},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/file", nil)
+		for name, value := range test.header {
+			req.Header.Set(name, value)
+		}
+		if status := checkConditions(req, modtime, etag); status != test.status {
+			t.Errorf("checkConditions(%v) = %d; want %d", test.header, status,
+				test.status)
+		}
+	}
+}
+
+func TestIfRangeMatches(t *testing.T) {
+	modtime := time.Date(2013, 5, 1, 12, 0, 0, 500, time.UTC)
+	etag := "\"abc\""
+
+	tests := []struct {
+		value string
+		match bool
+	}{
+		{"", true},
+		{"\"abc\"", true},
+		{"\"x\"", false},
+		{modtime.Format(http.TimeFormat), true},
+		{modtime.Add(-time.Hour).Format(http.TimeFormat), false},
+		{"yesterday", false},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/file", nil)
+		if test.value != "" {
+			req.Header.Set("If-Range", test.value)
+		}
+		if match := ifRangeMatches(req, modtime, etag); match != test.match {
+			t.Errorf("ifRangeMatches(%q) = %v; want %v", test.value, match,
+				test.match)
+		}
+	}
+}
@@ -0,0 +1,398 @@
+/*
+	gobal - reproxy.go
+
+	Reproxying, as done by Perlbal. A backend can answer a request with an
+	X-REPROXY-URL or X-REPROXY-FILE header instead of the content, and we go
+	and get the content from there ourselves. This keeps big files from tying
+	up application servers.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reproxyHeaders are the headers a backend uses to ask us to reproxy. They
+// are never passed on to the client.
+var reproxyHeaders = []string{
+	"X-Reproxy-Url",
+	"X-Reproxy-File",
+	"X-Reproxy-Cache-For",
+}
+
+// reproxyContentHeaders describe the content itself, so if the backend that
+// told us to reproxy didn't set them, we take them from wherever we got it.
+var reproxyContentHeaders = []string{
+	"Content-Type",
+	"Content-Range",
+	"Accept-Ranges",
+	"Last-Modified",
+	"Etag",
+}
+
+// reproxyRequestHeaders are passed on from the client when we fetch an
+// X-REPROXY-URL, so that whoever has the content can answer ranges and
+// conditional requests the same way we do for X-REPROXY-FILE.
+var reproxyRequestHeaders = []string{
+	"Range",
+	"If-Range",
+	"If-Match",
+	"If-None-Match",
+	"If-Modified-Since",
+	"If-Unmodified-Since",
+}
+
+// reproxyClient fetches X-REPROXY-URL content. We don't want to wait forever
+// for a server to start answering, but the body can take as long as it needs.
+var reproxyClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 3 * time.Second,
+		}).DialContext,
+		ResponseHeaderTimeout: 10 * time.Second,
+		DisableCompression:    true,
+		MaxIdleConnsPerHost:   10,
+	},
+}
+
+// reproxyEntry is a cached answer from a backend: where to find the content
+// for a URI, and the headers to send along with it.
+type reproxyEntry struct {
+	urls    []string
+	header  http.Header
+	expires time.Time
+}
+
+// reproxyFileBody is all or part of an X-REPROXY-FILE, which is closed when
+// the client is done with it.
+type reproxyFileBody struct {
+	io.Reader
+	file *os.File
+}
+
+// ReproxyCache remembers X-REPROXY-URL answers that the backend said could be
+// cached, with X-REPROXY-CACHE-FOR, so that we don't have to ask it again.
+type ReproxyCache struct {
+	lock    sync.Mutex
+	max     int
+	entries map[string]*reproxyEntry
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// Reproxying
+//////////////////////////////////////////////////////////////////////////////
+
+// WantsReproxy returns true if a backend response asks us to reproxy.
+func WantsReproxy(resp *http.Response) bool {
+	return resp.Header.Get("X-Reproxy-Url") != "" ||
+		resp.Header.Get("X-Reproxy-File") != ""
+}
+
+// reproxy handles a backend response that asked us to reproxy. The backend
+// is done with once we have its headers.
+func (s *Service) reproxy(req ServiceRequest, be *HttpBackendConnection,
+	resp *http.Response) {
+	be.Attach(req.client, resp, s.PersistBackend)
+	resp.Body.Close()
+	s.Stats.Add("reproxy.requests", 1)
+
+	header := resp.Header.Clone()
+	for _, name := range reproxyHeaders {
+		header.Del(name)
+	}
+	header.Del("Content-Length")
+	header.Del("Transfer-Encoding")
+
+	if file := resp.Header.Get("X-Reproxy-File"); file != "" {
+		s.respond(req, s.reproxyFile(req, file, header))
+		return
+	}
+
+	// Only GET and HEAD are answered from the cache, so nothing else may
+	// go into it; a POST mustn't decide what a later GET gets.
+	urls := strings.Fields(resp.Header.Get("X-Reproxy-Url"))
+	method := req.request.Method
+	if s.reproxyCache != nil && (method == "GET" || method == "HEAD") {
+		if secs, names, ok := parseCacheFor(resp.Header); ok {
+			entry := &reproxyEntry{
+				urls:    urls,
+				header:  make(http.Header),
+				expires: time.Now().Add(time.Duration(secs) * time.Second),
+			}
+			for _, name := range names {
+				if values, ok := header[http.CanonicalHeaderKey(name)]; ok {
+					entry.header[http.CanonicalHeaderKey(name)] = values
+				}
+			}
+			s.reproxyCache.Put(reproxyCacheKey(req.request), entry)
+		}
+	}
+	s.respond(req, s.reproxyUrls(req, urls, header))
+}
+
+// reproxyFromCache answers a request from the reproxy cache, if we can. This
+// returns false if the request has to go to a backend.
+func (s *Service) reproxyFromCache(req ServiceRequest) bool {
+	if s.reproxyCache == nil {
+		return false
+	}
+	if req.request.Method != "GET" && req.request.Method != "HEAD" {
+		return false
+	}
+	entry := s.reproxyCache.Get(reproxyCacheKey(req.request))
+	if entry == nil {
+		return false
+	}
+
+	s.Stats.Add("reproxy.cache_hits", 1)
+	go func() {
+		s.respond(req, s.reproxyUrls(req, entry.urls, entry.header.Clone()))
+	}()
+	return true
+}
+
+// reproxyUrls fetches the content from the first of the URLs that gives it
+// to us. The client's Range and conditional headers are passed along, so
+// partial and not modified responses work too.
+func (s *Service) reproxyUrls(req ServiceRequest, urls []string,
+	header http.Header) *http.Response {
+	method := "GET"
+	if req.request.Method == "HEAD" {
+		method = "HEAD"
+	}
+
+	err := errors.New("no reproxy URLs")
+	for _, url := range urls {
+		var out *http.Request
+		if out, err = http.NewRequest(method, url, nil); err != nil {
+			continue
+		}
+		for _, name := range reproxyRequestHeaders {
+			if value := req.request.Header.Get(name); value != "" {
+				out.Header.Set(name, value)
+			}
+		}
+
+		var tresp *http.Response
+		if tresp, err = reproxyClient.Do(out); err != nil {
+			log.Debug("reproxy %s: %s", url, err)
+			continue
+		}
+		switch tresp.StatusCode {
+		case 200, 206, 304, 412, 416:
+		default:
+			tresp.Body.Close()
+			err = errors.New(fmt.Sprintf("%s returned %s", url, tresp.Status))
+			log.Debug("reproxy %s: %s", url, err)
+			continue
+		}
+
+		for _, name := range reproxyContentHeaders {
+			if header.Get(name) == "" && tresp.Header.Get(name) != "" {
+				header[name] = tresp.Header[name]
+			}
+		}
+		if tresp.StatusCode >= 300 {
+			// The client's conditions or ranges weren't met. That's an answer
+			// for the client, not a failure.
+			tresp.Body.Close()
+			return reproxyResponse(req.request, tresp.Status,
+				tresp.StatusCode, header, 0, nil)
+		}
+		return reproxyResponse(req.request, tresp.Status, tresp.StatusCode,
+			header, tresp.ContentLength, tresp.Body)
+	}
+
+	log.Error("reproxy failed for %s: %s", req.request.RequestURI, err)
+	s.Stats.Add("reproxy.failures", 1)
+	return HttpErrorResponse(req.request, err)
+}
+
+// reproxyFile sends the contents of a local file. Conditional and range
+// requests are handled just like files we serve ourselves.
+func (s *Service) reproxyFile(req ServiceRequest, file string,
+	header http.Header) *http.Response {
+	f, err := os.Open(file)
+	if err != nil {
+		s.Stats.Add("reproxy.failures", 1)
+		return HttpErrorResponse(req.request, err)
+	}
+	fi, err := f.Stat()
+	if err == nil && fi.IsDir() {
+		err = errors.New(fmt.Sprintf("%s is a directory", file))
+	}
+	if err != nil {
+		f.Close()
+		s.Stats.Add("reproxy.failures", 1)
+		return HttpErrorResponse(req.request, err)
+	}
+
+	// The backend may know better than the file what to call this version.
+	size, modtime := fi.Size(), fi.ModTime()
+	if header.Get("Last-Modified") == "" {
+		header.Set("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+	} else if lm, err := http.ParseTime(header.Get("Last-Modified")); err == nil {
+		modtime = lm
+	}
+	if header.Get("Etag") == "" {
+		header.Set("Etag", FileEtag(fi))
+	}
+	etag := header.Get("Etag")
+
+	if status := checkConditions(req.request, modtime, etag); status != 0 {
+		f.Close()
+		return reproxyResponse(req.request, StatusForCode(status), status,
+			header, 0, nil)
+	}
+	header.Set("Accept-Ranges", "bytes")
+
+	var ranges []byteRange
+	if ifRangeMatches(req.request, modtime, etag) {
+		ranges, err = parseRange(req.request.Header.Get("Range"), size)
+	}
+	if err == errRangeUnsatisfiable {
+		f.Close()
+		header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		return reproxyResponse(req.request,
+			StatusForCode(http.StatusRequestedRangeNotSatisfiable),
+			http.StatusRequestedRangeNotSatisfiable, header, 0, nil)
+	}
+
+	body := &reproxyFileBody{Reader: f, file: f}
+	switch {
+	case len(ranges) == 1:
+		header.Set("Content-Range", ranges[0].contentRange(size))
+		body.Reader = io.NewSectionReader(f, ranges[0].start, ranges[0].length)
+		size = ranges[0].length
+	case len(ranges) > 1:
+		var ctype string
+		body.Reader, size, ctype = multipartRanges(f, ranges, size,
+			header.Get("Content-Type"))
+		header.Set("Content-Type", ctype)
+	}
+	if len(ranges) > 0 {
+		return reproxyResponse(req.request,
+			StatusForCode(http.StatusPartialContent),
+			http.StatusPartialContent, header, size, body)
+	}
+	return reproxyResponse(req.request, "200 OK", 200, header, size, body)
+}
+
+// reproxyResponse puts together what we send the client. However we got the
+// content, the client sees HTTP/1.1.
+func reproxyResponse(req *http.Request, status string, code int,
+	header http.Header, length int64, body io.ReadCloser) *http.Response {
+	resp := &http.Response{
+		Request:       req,
+		Status:        status,
+		StatusCode:    code,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		ContentLength: length,
+		Body:          body,
+	}
+	if length < 0 {
+		resp.TransferEncoding = []string{"chunked"}
+	}
+	return resp
+}
+
+// parseCacheFor reads X-REPROXY-CACHE-FOR, which is a number of seconds and
+// then, optionally, the headers to send along with cached answers:
+//
+//	X-REPROXY-CACHE-FOR: 300; Content-Type Cache-Control
+func parseCacheFor(hdr http.Header) (int, []string, bool) {
+	value := hdr.Get("X-Reproxy-Cache-For")
+	if value == "" {
+		return 0, nil, false
+	}
+
+	parts := strings.SplitN(value, ";", 2)
+	secs, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || secs <= 0 {
+		return 0, nil, false
+	}
+	var names []string
+	if len(parts) > 1 {
+		names = strings.Fields(parts[1])
+	}
+	return secs, names, true
+}
+
+// reproxyCacheKey is what cached answers are stored under.
+func reproxyCacheKey(req *http.Request) string {
+	return req.Host + " " + req.RequestURI
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// reproxyFileBody implementation
+//////////////////////////////////////////////////////////////////////////////
+
+func (b *reproxyFileBody) Close() error {
+	return b.file.Close()
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// ReproxyCache implementation
+//////////////////////////////////////////////////////////////////////////////
+
+// NewReproxyCache makes a cache that holds up to max answers.
+func NewReproxyCache(max int) *ReproxyCache {
+	return &ReproxyCache{
+		max:     max,
+		entries: make(map[string]*reproxyEntry),
+	}
+}
+
+// Get returns the cached answer for a key, if there is one that hasn't
+// expired.
+func (c *ReproxyCache) Get(key string) *reproxyEntry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	return entry
+}
+
+// Put stores an answer. If we're full, expired answers are thrown out first,
+// then whatever else it takes to make room.
+func (c *ReproxyCache) Put(key string, entry *reproxyEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.max {
+		now := time.Now()
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < c.max {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = entry
+}
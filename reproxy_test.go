@@ -0,0 +1,49 @@
+/*
+	gobal - reproxy_test.go
+
+	Tests for reading reproxy headers from backends.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParseCacheFor(t *testing.T) {
+	tests := []struct {
+		value string
+		secs  int
+		names string
+		ok    bool
+	}{
+		{"300", 300, "", true},
+		{" 300 ", 300, "", true},
+		{"300; Content-Type Cache-Control", 300, "Content-Type Cache-Control",
+			true},
+		{"300;  Content-Type  ", 300, "Content-Type", true},
+		{"300;", 300, "", true},
+
+		{"", 0, "", false},
+		{"0", 0, "", false},
+		{"-5", 0, "", false},
+		{"soon", 0, "", false},
+		{"; Content-Type", 0, "", false},
+	}
+
+	for _, test := range tests {
+		hdr := make(http.Header)
+		if test.value != "" {
+			hdr.Set("X-REPROXY-CACHE-FOR", test.value)
+		}
+		secs, names, ok := parseCacheFor(hdr)
+		if secs != test.secs || strings.Join(names, " ") != test.names ||
+			ok != test.ok {
+			t.Errorf("%q: got %d, %q, %v", test.value, secs, names, ok)
+		}
+	}
+}
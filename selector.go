@@ -0,0 +1,414 @@
+/*
+	gobal - selector.go
+
+	The selector role. A selector doesn't handle requests itself, it picks
+	another service to hand each one to. Which one is picked by the Host
+	header, configured with VHOST lines:
+
+		VHOST www.site.com = site
+		VHOST *.site.com   = site
+		VHOST *            = default_site
+
+	Exact names win, then the closest wildcard, then the default. A wildcard
+	also matches the bare domain, so *.site.com covers site.com too.
+
+	Requests can also be picked by what they ask for, with ROUTE lines. These
+	are tried in order before the vhosts, and the first one to match wins:
+
+		ROUTE path /api             = api     strip
+		ROUTE path /static          = static  rewrite /assets
+		ROUTE regex ^/u/(\d+)$      = users   rewrite /user?id=$1
+		ROUTE method POST           = writers
+		ROUTE header X-Beta: ^yes$  = beta
+
+	A path matches whole segments, so /api doesn't match /apidocs. The target
+	of a route or vhost can be another selector, to route by host and then by
+	path.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// MAX_SELECT_DEPTH is how many selectors a request can go through before we
+// decide that they're pointing at each other.
+const MAX_SELECT_DEPTH = 8
+
+// VhostMap holds the host patterns for a selector and the names of the
+// services they go to. The services are looked up when a request comes in,
+// so they can be created in any order.
+type VhostMap struct {
+	lock  sync.RWMutex
+	hosts map[string]string
+}
+
+// Route is a single ROUTE line. Which of the match fields is used depends on
+// the kind; the rewrite is only for path and regex routes.
+type Route struct {
+	Kind    string
+	Prefix  string
+	Regexp  *regexp.Regexp
+	Method  string
+	Header  string
+	Strip   bool
+	Rewrite *string
+	Service string
+}
+
+// RouteTable is the list of routes for a selector, in the order they're tried.
+type RouteTable struct {
+	lock   sync.RWMutex
+	routes []*Route
+}
+
+// vhostsPlugin is here so that Perlbal configurations work. Perlbal needs it
+// for VHOST lines, but our selectors always understand them.
+type vhostsPlugin struct {
+	BasePlugin
+}
+
+func init() {
+	RegisterPlugin(vhostsPlugin{})
+	ConfigMap[`^VHOST\s+(?:(\w+)\s+)?(\S+)\s*=\s*(\w*)$`] = cfg_Vhost
+	ConfigMap[`^ROUTE\s+(?:(\w+)\s+)?(path|regex|method|header)\s+(.+?)`+
+		`\s*=\s*(\w+)(?:\s+(strip|rewrite\s+\S+))?$`] = cfg_Route
+}
+
+// selectorFor finds the selector a VHOST or ROUTE line is for. It can be
+// named, otherwise it's the service we're configuring.
+func selectorFor(cur *Interactor, name string) (*Service, error) {
+	var svc *Service
+	if name != "" {
+		var ok bool
+		if svc, ok = GetService(name); !ok {
+			return nil, errors.New(fmt.Sprintf("service '%s' not found", name))
+		}
+	} else if cur != nil {
+		svc, _ = (*cur).(*Service)
+	}
+	if svc == nil {
+		return nil, errors.New("no service defined")
+	}
+	if svc.Role != ROLE_SELECTOR {
+		return nil, errors.New(fmt.Sprintf("service '%s' is not a selector",
+			svc.Name))
+	}
+	return svc, nil
+}
+
+// cfg_Vhost adds a host pattern to a selector. An empty target removes the
+// pattern.
+func cfg_Vhost(cur *Interactor, m []string) error {
+	svc, err := selectorFor(cur, m[1])
+	if err != nil {
+		return err
+	}
+	return svc.vhosts.Set(m[2], m[3])
+}
+
+// cfg_Route adds a route to the end of a selector's list.
+func cfg_Route(cur *Interactor, m []string) error {
+	svc, err := selectorFor(cur, m[1])
+	if err != nil {
+		return err
+	}
+	route, err := NewRoute(strings.ToLower(m[2]), m[3], m[4], m[5])
+	if err != nil {
+		return err
+	}
+	svc.routes.Add(route)
+	return nil
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// Selecting services
+//////////////////////////////////////////////////////////////////////////////
+
+// selectRequest hands a request to the service that its routes or Host
+// header map to. If nothing matches, the client gets a 404 from us. The
+// depth is how many selectors the request has already been through.
+func (s *Service) selectRequest(conn Client, req *http.Request,
+	rchan chan *http.Response, depth int) error {
+	if depth >= MAX_SELECT_DEPTH {
+		return errors.New(fmt.Sprintf("selector %s: too many selectors",
+			s.Name))
+	}
+
+	route := s.routes.Match(req)
+	name := ""
+	if route != nil {
+		name = route.Service
+	} else {
+		host := req.Host
+		if host == "" {
+			host = req.URL.Host
+		}
+		name = s.vhosts.Lookup(host)
+	}
+
+	target, ok := GetService(name)
+	if name != "" && !ok {
+		log.Warn("selector %s: service '%s' not found", s.Name, name)
+	}
+	if target == nil {
+		s.Stats.Add("vhost.unmatched", 1)
+		s.respond(ServiceRequest{client: conn, request: req, rchan: rchan},
+			HttpSimpleResponse(req, 404, "No service for this host"))
+		return nil
+	}
+
+	if route != nil {
+		if err := route.Apply(req); err != nil {
+			return err
+		}
+	}
+	if target.Role == ROLE_SELECTOR {
+		return target.selectRequest(conn, req, rchan, depth+1)
+	}
+	return target.HandleRequest(conn, req, rchan)
+}
+
+func (p vhostsPlugin) Name() string {
+	return "vhosts"
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// VhostMap implementation
+//////////////////////////////////////////////////////////////////////////////
+
+// NewVhostMap makes an empty map.
+func NewVhostMap() *VhostMap {
+	return &VhostMap{hosts: make(map[string]string)}
+}
+
+// Set points a pattern at a service, or removes it if there's no service.
+// Patterns are a host name, a wildcard like *.site.com, or * for anything
+// not otherwise matched.
+func (v *VhostMap) Set(pattern, service string) error {
+	pattern = strings.ToLower(pattern)
+	if strings.Contains(pattern[1:], "*") ||
+		(strings.HasPrefix(pattern, "*") && pattern != "*" &&
+			!strings.HasPrefix(pattern, "*.")) {
+		return errors.New(fmt.Sprintf("invalid vhost '%s'", pattern))
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if service == "" {
+		delete(v.hosts, pattern)
+	} else {
+		v.hosts[pattern] = service
+	}
+	return nil
+}
+
+// Lookup finds the service name for a Host header. Any port is ignored. This
+// returns "" if nothing matches.
+func (v *VhostMap) Lookup(host string) string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	if name, ok := v.hosts[host]; ok {
+		return name
+	}
+
+	// Try ever shorter wildcards: *.www.site.com, *.site.com, *.com.
+	for domain := host; domain != ""; {
+		if name, ok := v.hosts["*."+domain]; ok {
+			return name
+		}
+		i := strings.Index(domain, ".")
+		if i < 0 {
+			break
+		}
+		domain = domain[i+1:]
+	}
+	return v.hosts["*"]
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// Route implementation
+//////////////////////////////////////////////////////////////////////////////
+
+// NewRoute builds a route from the parts of a ROUTE line. The action is
+// "strip", "rewrite <path>" or empty.
+func NewRoute(kind, match, service, action string) (*Route, error) {
+	route := &Route{Kind: kind, Service: service}
+	switch kind {
+	case "path":
+		if !strings.HasPrefix(match, "/") {
+			return nil, errors.New(fmt.Sprintf("invalid route path '%s'",
+				match))
+		}
+		route.Prefix = strings.TrimSuffix(match, "/")
+	case "regex":
+		re, err := regexp.Compile(match)
+		if err != nil {
+			return nil, err
+		}
+		route.Regexp = re
+	case "method":
+		route.Method = strings.ToUpper(match)
+	case "header":
+		// Either a name, which just has to be there, or a name and a pattern
+		// for the value.
+		parts := strings.SplitN(match, ":", 2)
+		route.Header = http.CanonicalHeaderKey(strings.TrimSpace(parts[0]))
+		if len(parts) > 1 {
+			re, err := regexp.Compile(strings.TrimSpace(parts[1]))
+			if err != nil {
+				return nil, err
+			}
+			route.Regexp = re
+		}
+	}
+
+	fields := strings.Fields(action)
+	if len(fields) == 0 {
+		return route, nil
+	}
+	if kind != "path" && kind != "regex" {
+		return nil, errors.New(fmt.Sprintf("%s routes can't %s", kind,
+			strings.ToLower(fields[0])))
+	}
+	if strings.ToLower(fields[0]) == "strip" {
+		if kind != "path" {
+			return nil, errors.New("only path routes can strip")
+		}
+		route.Strip = true
+	} else {
+		route.Rewrite = &fields[1]
+	}
+	return route, nil
+}
+
+// Matches returns true if this route is for the request.
+func (r *Route) Matches(req *http.Request) bool {
+	switch r.Kind {
+	case "path":
+		p := req.URL.Path
+		return p == r.Prefix || r.Prefix == "" ||
+			(strings.HasPrefix(p, r.Prefix) && p[len(r.Prefix)] == '/')
+	case "regex":
+		return r.Regexp.MatchString(req.URL.Path)
+	case "method":
+		return req.Method == r.Method
+	case "header":
+		values, ok := req.Header[r.Header]
+		if !ok || r.Regexp == nil {
+			return ok
+		}
+		for _, value := range values {
+			if r.Regexp.MatchString(value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Apply changes the request's path, if the route says to. The query string
+// is kept unless the rewrite has one of its own.
+func (r *Route) Apply(req *http.Request) error {
+	if !r.Strip && r.Rewrite == nil {
+		return nil
+	}
+
+	rewrite, query, newQuery := "", req.URL.RawQuery, false
+	if r.Rewrite != nil {
+		rewrite = *r.Rewrite
+		if i := strings.Index(rewrite, "?"); i >= 0 {
+			rewrite, query, newQuery = rewrite[:i], rewrite[i+1:], true
+		}
+	}
+
+	// Path routes keep the rest of the path as the client escaped it, so an
+	// escaped ? or / stays that way. Regex routes work on the decoded path,
+	// which is escaped again when we're done.
+	var u url.URL
+	if r.Kind == "path" {
+		u.RawPath = strings.TrimSuffix(rewrite, "/") +
+			escapedRest(req.URL, len(r.Prefix))
+		if !strings.HasPrefix(u.RawPath, "/") {
+			u.RawPath = "/" + u.RawPath
+		}
+		path, err := url.PathUnescape(u.RawPath)
+		if err != nil {
+			return err
+		}
+		u.Path = path
+	} else {
+		p := req.URL.Path
+		m := r.Regexp.FindStringSubmatchIndex(p)
+		u.Path = p[:m[0]] + string(r.Regexp.ExpandString(nil, rewrite, p, m)) +
+			p[m[1]:]
+		if !strings.HasPrefix(u.Path, "/") {
+			u.Path = "/" + u.Path
+		}
+		if newQuery {
+			query = string(r.Regexp.ExpandString(nil, query, p, m))
+		}
+	}
+
+	req.URL.Path, req.URL.RawPath, req.URL.RawQuery = u.Path, u.RawPath, query
+	req.RequestURI = req.URL.RequestURI()
+	return nil
+}
+
+// escapedRest is the part of a URL's path after the first n bytes of the
+// decoded path, as the client escaped it. n has to end a path segment.
+func escapedRest(u *url.URL, n int) string {
+	escaped := u.EscapedPath()
+	for i := 0; i <= len(escaped); i++ {
+		if i < len(escaped) && escaped[i] != '/' {
+			continue
+		}
+		if p, err := url.PathUnescape(escaped[:i]); err == nil && len(p) == n {
+			return escaped[i:]
+		}
+	}
+	return (&url.URL{Path: u.Path[n:]}).EscapedPath()
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// RouteTable implementation
+//////////////////////////////////////////////////////////////////////////////
+
+// NewRouteTable makes an empty table.
+func NewRouteTable() *RouteTable {
+	return &RouteTable{}
+}
+
+// Add puts a route at the end of the table.
+func (t *RouteTable) Add(route *Route) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.routes = append(t.routes, route)
+}
+
+// Match returns the first route that's for the request, or nil.
+func (t *RouteTable) Match(req *http.Request) *Route {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	for _, route := range t.routes {
+		if route.Matches(req) {
+			return route
+		}
+	}
+	return nil
+}
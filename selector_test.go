@@ -0,0 +1,226 @@
+/*
+	gobal - selector_test.go
+
+	Tests for picking services by Host header and by route.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestVhostLookup(t *testing.T) {
+	v := NewVhostMap()
+	for pattern, service := range map[string]string{
+		"www.site.com":   "www",
+		"*.site.com":     "site",
+		"*.api.site.com": "api",
+		"OTHER.com":      "other",
+		"*":              "default",
+	} {
+		if err := v.Set(pattern, service); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		host    string
+		service string
+	}{
+		// Exact names win over wildcards.
+		{"www.site.com", "www"},
+		{"WWW.Site.Com", "www"},
+		{"www.site.com:8080", "www"},
+		{"www.site.com.", "www"},
+		{"other.com", "other"},
+
+		// Then the closest wildcard, which covers the bare domain too.
+		{"img.site.com", "site"},
+		{"a.b.site.com", "site"},
+		{"site.com", "site"},
+		{"v1.api.site.com", "api"},
+		{"api.site.com", "api"},
+
+		// Then the default.
+		{"notsite.com", "default"},
+		{"www.other.com", "default"},
+		{"", "default"},
+		{"[::1]:80", "default"},
+	}
+
+	for _, test := range tests {
+		if got := v.Lookup(test.host); got != test.service {
+			t.Errorf("Lookup(%q) = %q; want %q", test.host, got, test.service)
+		}
+	}
+
+	// Without a default, nothing matches. Removing a pattern works the same.
+	v.Set("*", "")
+	v.Set("*.site.com", "")
+	for _, host := range []string{"notsite.com", "img.site.com"} {
+		if got := v.Lookup(host); got != "" {
+			t.Errorf("Lookup(%q) = %q; want no match", host, got)
+		}
+	}
+}
+
+func TestVhostSetInvalid(t *testing.T) {
+	for _, pattern := range []string{"www.*.com", "*site.com", "**", "a*"} {
+		if err := NewVhostMap().Set(pattern, "x"); err == nil {
+			t.Errorf("Set(%q) was accepted", pattern)
+		}
+	}
+}
+
+func TestRouteMatches(t *testing.T) {
+	tests := []struct {
+		kind, match string
+		method      string
+		uri         string
+		header      map[string]string
+		matches     bool
+	}{
+		// Paths match whole segments.
+		{"path", "/api", "GET", "/api", nil, true},
+		{"path", "/api", "GET", "/api/users", nil, true},
+		{"path", "/api/", "GET", "/api/users", nil, true},
+		{"path", "/api", "GET", "/apidocs", nil, false},
+		{"path", "/api", "GET", "/", nil, false},
+		{"path", "/", "GET", "/anything", nil, true},
+
+		{"regex", `^/u/(\d+)$`, "GET", "/u/42", nil, true},
+		{"regex", `^/u/(\d+)$`, "GET", "/u/abc", nil, false},
+
+		{"method", "post", "POST", "/", nil, true},
+		{"method", "POST", "GET", "/", nil, false},
+
+		// A header with no pattern just has to be there.
+		{"header", "X-Beta", "GET", "/", map[string]string{"X-Beta": ""}, true},
+		{"header", "x-beta", "GET", "/", map[string]string{"X-Beta": "no"},
+			true},
+		{"header", "X-Beta", "GET", "/", nil, false},
+		{"header", "X-Beta: ^yes$", "GET", "/",
+			map[string]string{"X-Beta": "yes"}, true},
+		{"header", "X-Beta: ^yes$", "GET", "/",
+			map[string]string{"X-Beta": "yesno"}, false},
+	}
+
+	for _, test := range tests {
+		route, err := NewRoute(test.kind, test.match, "svc", "")
+		if err != nil {
+			t.Errorf("NewRoute(%s, %q): %s", test.kind, test.match, err)
+			continue
+		}
+		req, _ := http.NewRequest(test.method, test.uri, nil)
+		for name, value := range test.header {
+			req.Header.Set(name, value)
+		}
+		if got := route.Matches(req); got != test.matches {
+			t.Errorf("%s %q on %s %s = %v; want %v", test.kind, test.match,
+				test.method, test.uri, got, test.matches)
+		}
+	}
+}
+
+func TestRouteApply(t *testing.T) {
+	tests := []struct {
+		kind, match, action string
+		uri                 string
+		want                string
+	}{
+		{"path", "/api", "", "/api/users?x=1", "/api/users?x=1"},
+		{"path", "/api", "strip", "/api/users?x=1", "/users?x=1"},
+		{"path", "/api", "strip", "/api", "/"},
+		{"path", "/static", "rewrite /assets/", "/static/app.js",
+			"/assets/app.js"},
+		{"regex", `^/u/(\d+)$`, "rewrite /user?id=$1", "/u/42?x=1",
+			"/user?id=42"},
+		{"regex", `/old/`, "rewrite /new/", "/a/old/b?x=1", "/a/new/b?x=1"},
+
+		// Escapes in the path stay escapes, and don't become a query.
+		{"path", "/api", "strip", "/api/a%3Fb", "/a%3Fb"},
+		{"path", "/api", "strip", "/api/a%3Fb?x=1", "/a%3Fb?x=1"},
+		{"path", "/api", "strip", "/api/%25zz", "/%25zz"},
+		{"path", "/static", "rewrite /assets", "/static/a%2Fb", "/assets/a%2Fb"},
+		{"path", "/a b", "strip", "/a%20b/c", "/c"},
+		{"regex", `^/f/(.*)$`, "rewrite /files/$1", "/f/a%3Fb", "/files/a%3Fb"},
+	}
+
+	for _, test := range tests {
+		route, err := NewRoute(test.kind, test.match, "svc", test.action)
+		if err != nil {
+			t.Errorf("NewRoute(%s, %q, %q): %s", test.kind, test.match,
+				test.action, err)
+			continue
+		}
+		req, _ := http.NewRequest("GET", test.uri, nil)
+		req.RequestURI = test.uri
+		if err := route.Apply(req); err != nil {
+			t.Errorf("%s on %s: %s", test.action, test.uri, err)
+			continue
+		}
+		if req.RequestURI != test.want {
+			t.Errorf("%s %q %s on %s = %s; want %s", test.kind, test.match,
+				test.action, test.uri, req.RequestURI, test.want)
+		}
+	}
+}
+
+func TestNewRouteInvalid(t *testing.T) {
+	tests := []struct {
+		kind, match, action string
+	}{
+		{"path", "api", ""},
+		{"regex", "(", ""},
+		{"header", "X-Beta: (", ""},
+		{"regex", "^/a", "strip"},
+		{"method", "POST", "strip"},
+		{"header", "X-Beta", "rewrite /x"},
+	}
+
+	for _, test := range tests {
+		if _, err := NewRoute(test.kind, test.match, "svc",
+			test.action); err == nil {
+			t.Errorf("NewRoute(%s, %q, %q) was accepted", test.kind,
+				test.match, test.action)
+		}
+	}
+}
+
+func TestRouteTableOrder(t *testing.T) {
+	table := NewRouteTable()
+	for _, r := range []struct{ kind, match, service string }{
+		{"path", "/api/v2", "v2"},
+		{"path", "/api", "api"},
+		{"method", "POST", "writers"},
+	} {
+		route, _ := NewRoute(r.kind, r.match, r.service, "")
+		table.Add(route)
+	}
+
+	tests := []struct {
+		method, uri string
+		service     string
+	}{
+		{"GET", "/api/v2/x", "v2"},
+		{"POST", "/api/x", "api"},
+		{"POST", "/other", "writers"},
+		{"GET", "/other", ""},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, test.uri, nil)
+		got := ""
+		if route := table.Match(req); route != nil {
+			got = route.Service
+		}
+		if got != test.service {
+			t.Errorf("%s %s went to %q; want %q", test.method, test.uri, got,
+				test.service)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+/*
+	gobal - sendfile_linux.go
+
+	Sending files to sockets with sendfile(2). We pass the offset in, so the
+	file's own offset is never used and cached files can be shared.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+// MAX_SENDFILE_CHUNK is the most we ask the kernel for in one go.
+const MAX_SENDFILE_CHUNK = 1 << 30
+
+// sendfile copies part of a file to a TCP connection without it passing
+// through user space. This respects the connection's write deadline.
+func sendfile(conn *net.TCPConn, f *os.File, offset, length int64) (int64, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	fc, err := f.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var written int64
+	var serr error
+	cerr := fc.Control(func(ffd uintptr) {
+		err := rc.Write(func(sfd uintptr) bool {
+			for written < length {
+				chunk := length - written
+				if chunk > MAX_SENDFILE_CHUNK {
+					chunk = MAX_SENDFILE_CHUNK
+				}
+				n, err := syscall.Sendfile(int(sfd), int(ffd), &offset,
+					int(chunk))
+				if n > 0 {
+					written += int64(n)
+				}
+				switch {
+				case err == syscall.EAGAIN:
+					// Wait until the socket can take more.
+					return false
+				case err == syscall.EINTR:
+					continue
+				case err != nil:
+					serr = os.NewSyscallError("sendfile", err)
+					return true
+				case n == 0:
+					// The file got shorter since we looked at it.
+					serr = io.ErrUnexpectedEOF
+					return true
+				}
+			}
+			return true
+		})
+		if serr == nil {
+			serr = err
+		}
+	})
+	if serr == nil {
+		serr = cerr
+	}
+	return written, serr
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+
+/*
+	gobal - sendfile_other.go
+
+	Where we don't have sendfile(2) with an offset, files are copied through
+	user space instead.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+)
+
+// sendfile copies part of a file to a TCP connection.
+func sendfile(conn *net.TCPConn, f *os.File, offset, length int64) (int64, error) {
+	return io.Copy(conn, io.NewSectionReader(f, offset, length))
+}
@@ -11,15 +11,17 @@
 package main
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 type ServiceRole int
@@ -28,17 +30,21 @@ const (
 	ROLE_WEBSERVER ServiceRole = iota
 	ROLE_PROXY     ServiceRole = iota
 	ROLE_MANAGE    ServiceRole = iota
+	ROLE_TCP_PROXY ServiceRole = iota
+	ROLE_SELECTOR  ServiceRole = iota
+	ROLE_ECHO      ServiceRole = iota
 )
 
 // NOTE: We don't use pointers to this struct typically, since the contents of
 // the struct are just a few pointers. Just copy by value.
 type ServiceRequest struct {
-	client  *HttpConnection
+	client  Client
 	request *http.Request
 	rchan   chan *http.Response
 }
 
 type ServiceListener struct {
+	Kind     string
 	Listener *TcpListener
 	Acceptor AcceptorFunc
 }
@@ -49,13 +55,76 @@ type Service struct {
 	Enabled   bool
 	Role      ServiceRole
 	Listeners map[string]*ServiceListener
+	Stats     *ServiceStats
+
+	// Plugins, which can be changed while requests are using them
+	plugins     []Plugin
+	pluginsLock sync.Mutex
+
+	// SPDY and HTTP/2 related
+	EnableSpdy  bool
+	EnableHttp2 bool
+
+	// PROXY protocol from load balancers in front of us
+	ProxyProtocol bool
+	proxyTrusted  IPList
+
+	// TLS related
+	EnableSSL    bool
+	Certs        *CertStore
+	ClientAuth   *ClientVerifier
+	sslCertFiles []string
+	sslKeyFiles  []string
+	sslCertDir   string
+	sslVerify    string
+	sslClientCA  string
+	sslClientCRL string
+	sslHeaders   map[string]string
+	tlsConfig    *tls.Config
 
 	// ROLE_WEBSERVER related
-	DocRoot string
+	DocRoot         string
+	DirIndexing     bool
+	IndexFiles      []string
+	MimeTypes       MimeTypes
+	DefaultMimeType string
+	GzipStatic      bool
+	Gzip            bool
+	GzipMinLength   int64
+	GzipMaxLength   int64
+	GzipTypes       []string
+	EnablePut       bool
+	EnableDelete    bool
+	MinPutDir       int
+	MaxPutSize      int64
+	writeAllow      IPList
+	files           *FileCache
+	gzipCache       *GzipCache
 
 	// ROLE_PROXY related
-	Pool         *Pool
-	requestQueue chan ServiceRequest
+	Pool           *Pool
+	PersistBackend bool
+	UpgradeIdle    time.Duration
+	BufferUploads  bool
+	UploadPath     string
+	UploadMemory   int64
+	MaxUpload      int64
+	EnableReproxy  bool
+	reproxyCache   *ReproxyCache
+	ForwardedRFC   bool
+	trustedProxies IPList
+	requestQueue   chan ServiceRequest
+
+	// ROLE_TCP_PROXY related
+	TcpIdle time.Duration
+
+	// ROLE_SELECTOR related
+	vhosts *VhostMap
+	routes *RouteTable
+
+	// ROLE_ECHO related
+	EchoDelay time.Duration
+	EchoJson  bool
 }
 
 var serviceLock sync.Mutex
@@ -74,6 +143,15 @@ func ServiceDefault(key, value string) {
 	}
 }
 
+// GetService returns the service with a given name. Services can be created
+// from the management port at any time, so the map is only read under lock.
+func GetService(name string) (*Service, bool) {
+	serviceLock.Lock()
+	defer serviceLock.Unlock()
+	svc, ok := services[name]
+	return svc, ok
+}
+
 //////////////////////////////////////////////////////////////////////////////
 // Service base implementation
 //////////////////////////////////////////////////////////////////////////////
@@ -94,6 +172,20 @@ func NewService(name string) (*Service, error) {
 		Enabled:   false,
 		Role:      ROLE_WEBSERVER,
 		Listeners: make(map[string]*ServiceListener),
+		Stats:     NewServiceStats(),
+
+		IndexFiles:    []string{"index.html"},
+		GzipMinLength: 1024,
+		GzipMaxLength: 10 * 1024 * 1024,
+		files:         NewFileCache(0),
+		gzipCache:     NewGzipCache(10 * 1024 * 1024),
+		UpgradeIdle:   5 * time.Minute,
+		UploadPath:    os.TempDir(),
+		UploadMemory:  256 * 1024,
+		sslHeaders:    make(map[string]string),
+		vhosts:        NewVhostMap(),
+		routes:        NewRouteTable(),
+		requestQueue:  make(chan ServiceRequest, 1000),
 	}
 
 	go services[name].requestPump()
@@ -101,43 +193,6 @@ func NewService(name string) (*Service, error) {
 	return services[name], nil
 }
 
-// serveFile takes as input a request from a client and then does something
-// useful with that request. This is only called on ROLE_WEBSERVER services.
-func (s *Service) serveFile(req ServiceRequest) {
-	filepath, err := CleanPath(s.DocRoot, req.request.RequestURI)
-	if err != nil {
-		req.rchan <- HttpErrorResponse(req.request, err)
-		return
-	}
-
-	fi, err := os.Stat(filepath)
-	if err != nil {
-		req.rchan <- HttpErrorResponse(req.request, err)
-		return
-	}
-
-	// If it's a directory, try appending index.html
-	if fi.IsDir() {
-		filepath = path.Join(filepath, "index.html")
-	}
-
-	f, err := os.Open(filepath)
-	if err != nil {
-		req.rchan <- HttpErrorResponse(req.request, err)
-		return
-	}
-
-	// TODO: Don't read the file into main memory. Splice it, send this
-	// reading filehandle to the user's writing filehandle...
-	rd, err := ioutil.ReadAll(f)
-	if err != nil {
-		req.rchan <- HttpErrorResponse(req.request, err)
-		return
-	}
-
-	req.rchan <- HttpSimpleResponse(req.request, 200, string(rd))
-}
-
 // requestPump is a goroutine. It takes incoming requests and does something
 // useful with them. This might be serving them (in the case of webserver) or
 // it could match them up with backends.
@@ -155,23 +210,202 @@ func (s *Service) requestPump() {
 
 		if s.Role == ROLE_WEBSERVER {
 			go s.serveFile(req)
-			return
+			continue
+		} else if s.Role == ROLE_ECHO {
+			go s.echoRequest(req)
+			continue
 		} else if s.Role != ROLE_PROXY {
 			log.Error("unexpected role in Service.requestPump")
-			req.rchan <- HttpErrorResponse(req.request,
-				errors.New("Invalid service type"))
+			s.respond(req, HttpErrorResponse(req.request,
+				errors.New("Invalid service type")))
+			continue
+		} else if s.Pool == nil {
+			s.respond(req, ProxyErrorResponse(req.request,
+				errors.New("no pool configured")))
+			continue
+		} else if s.Pool.Multiplexed() && upgradeFor(req) != "" {
+			// This has to be caught before we reserve a stream for it, as
+			// there's no giving the reservation back without using it.
+			s.respond(req, HttpErrorResponse(req.request,
+				errors.New("upgrades need an HTTP/1.1 backend")))
+			continue
+		}
+
+		// At this point we're guaranteed to be a ROLE_PROXY. We might already
+		// know where to reproxy this, otherwise fetch a backend. That can
+		// take a while if the backends are slow to connect, and mustn't hold
+		// up everyone else.
+		if s.reproxyFromCache(req) {
+			continue
+		}
+		if s.BufferUploads && HasBody(req.request) {
+			go s.bufferRequest(req)
+			continue
+		}
+		if !s.limitUpload(req) {
+			continue
+		}
+		go s.getBackendAndProxy(req)
+	}
+}
+
+// getBackendAndProxy waits for a backend connection for this request's
+// client, then proxies the request over it. This is a goroutine.
+func (s *Service) getBackendAndProxy(req ServiceRequest) {
+	be := s.Pool.GetBackendFor(req.client)
+	if be == nil {
+		s.respond(req, ProxyErrorResponse(req.request,
+			errors.New("no backends available")))
+		return
+	}
+	s.proxyRequest(req, be)
+}
+
+// proxyRequest sends a request to a backend and hands the response back to
+// the client. If an idle connection turns out to have been closed by the
+// backend, we try once more on a new one as long as there's no body that we
+// might have already partly sent.
+func (s *Service) proxyRequest(req ServiceRequest, be *HttpBackendConnection) {
+	// gRPC servers want to know that the client understands trailers. Since
+	// we pass them on, that's still true after we strip the hop headers.
+	// Upgrades to multiplexed backends were turned away in requestPump.
+	upgrade := ""
+	if be.h2 == nil {
+		upgrade = upgradeFor(req)
+	}
+
+	RemoveHopHeaders(req.request.Header)
+	addr := req.client.RemoteAddr()
+	SetForwardedHeaders(req.request, addr, s.trustedProxies.Contains(addr),
+		s.ForwardedRFC)
+	if IsGrpcRequest(req.request) {
+		req.request.Header.Set("Te", "trailers")
+	}
+	if upgrade != "" {
+		req.request.Header.Set("Connection", "Upgrade")
+		req.request.Header.Set("Upgrade", upgrade)
+	}
+
+	s.runBackendChosen(req.request, be)
+	resp, err := be.RoundTrip(req.request)
+	if err != nil && be.reused && req.request.Body == http.NoBody {
+		log.Debug("idle backend %s went away, retrying", be.Backend.Ipport)
+		be.Close()
+		if be = s.Pool.GetBackendFor(req.client); be == nil {
+			s.respond(req, ProxyErrorResponse(req.request,
+				errors.New("no backends available")))
 			return
 		}
+		s.runBackendChosen(req.request, be)
+		resp, err = be.RoundTrip(req.request)
+	}
+	if err != nil && UploadTooLarge(req.request) {
+		be.Close()
+		s.Stats.Add("uploads.too_large", 1)
+		s.respond(req, UploadTooLargeResponse(req.request))
+		return
+	} else if err != nil {
+		log.Error("backend %s failed: %s", be.Backend.Ipport, err)
+		be.Close()
+		s.Stats.Add("backend_errors", 1)
+		s.respond(req, ProxyErrorResponse(req.request, err))
+		return
+	}
 
-		// At this point we're guaranteed to be a ROLE_PROXY. Fetch a backend,
-		// which might block a bit.
-		be := s.Pool.GetBackend()
+	// When the backend agrees to switch protocols, the client gets the raw
+	// connection instead of a body, and the two are spliced together.
+	if upgrade != "" && resp.StatusCode == http.StatusSwitchingProtocols {
+		resp.Body = &upgradedBackend{
+			bufferedConn: &bufferedConn{be.Conn.Conn, be.Conn.BReader},
+			hconn:        be,
+		}
+		s.respond(req, resp)
+		return
+	}
+
+	RemoveHopHeaders(resp.Header)
+	s.runBackendResponse(req.request, resp)
+	if s.EnableReproxy && WantsReproxy(resp) {
+		s.reproxy(req, be, resp)
+		return
 	}
+	be.Attach(req.client, resp, s.PersistBackend)
+	s.respond(req, resp)
+}
+
+// respond hands a response back to the client that asked for it. The request
+// is logged once the client is done with the body.
+func (s *Service) respond(req ServiceRequest, resp *http.Response) {
+	s.runClientWrite(req.request, resp)
+	if resp.Body == nil || resp.StatusCode == http.StatusSwitchingProtocols {
+		s.logRequest(req, resp)
+	} else {
+		resp.Body = &statsBody{
+			ReadCloser: resp.Body,
+			stats:      s.Stats,
+			done:       func() { s.logRequest(req, resp) },
+		}
+	}
+	req.rchan <- resp
 }
 
 // Enable is called when we're done doing setup and need to activate things such
 // as our listeners.
 func (s *Service) Enable() error {
+	// Anyone could claim to be anyone if we took a PROXY header from all
+	// comers, so the proxies have to be listed.
+	if s.ProxyProtocol && s.proxyTrusted == nil {
+		return errors.New(fmt.Sprintf("service %s: proxy_protocol needs "+
+			"proxy_protocol_trusted", s.Name))
+	}
+
+	if s.EnableSSL && s.Certs == nil {
+		certs, err := NewCertStore(s.sslCertFiles, s.sslKeyFiles, s.sslCertDir)
+		if err != nil {
+			return err
+		}
+		if err = certs.Reload(); err != nil {
+			return err
+		}
+		go certs.reloadWorker()
+
+		s.Certs = certs
+		s.tlsConfig = certs.TlsConfig()
+		if s.EnableHttp2 {
+			s.tlsConfig.NextProtos = append(s.tlsConfig.NextProtos, "h2")
+		}
+		if s.EnableSpdy {
+			s.tlsConfig.NextProtos = append(s.tlsConfig.NextProtos, "spdy/3.1")
+		}
+		s.tlsConfig.NextProtos = append(s.tlsConfig.NextProtos, "http/1.1")
+
+		if s.sslVerify != "" && s.sslVerify != "off" {
+			cv, err := NewClientVerifier(s.sslVerify, s.sslClientCA,
+				s.sslClientCRL)
+			if err != nil {
+				return err
+			}
+			if hdr, ok := s.sslHeaders["subject"]; ok {
+				cv.SubjectHeader = hdr
+			}
+			if hdr, ok := s.sslHeaders["fingerprint"]; ok {
+				cv.FingerprintHeader = hdr
+			}
+			cv.Apply(s.tlsConfig)
+			s.ClientAuth = cv
+		}
+	}
+
+	if !s.EnableSSL && s.sslVerify != "" && s.sslVerify != "off" {
+		log.Warn("service %s: ssl_verify_client does nothing without "+
+			"enable_ssl", s.Name)
+	}
+
+	if (s.EnablePut || s.EnableDelete) && s.writeAllow == nil {
+		log.Warn("service %s: no write_allow, so PUT and DELETE are refused",
+			s.Name)
+	}
+
 	for ipport, lstnr := range s.Listeners {
 		if lstnr.Listener != nil {
 			continue
@@ -190,16 +424,18 @@ func (s *Service) Enable() error {
 	return nil
 }
 
-// setListen takes a new listen string and handles it.
-func (s *Service) setListen(value string, acceptor AcceptorFunc) error {
-	if len(s.Listeners) > 0 {
-		log.Warn("changing existing listeners on service %s", s.Name)
-	}
-
+// setListen takes a new listen string and handles it. The kind lets a service
+// have several sets of listeners, i.e. "listen" and "listen_spdy", without
+// one setting replacing the other.
+func (s *Service) setListen(value, kind string, acceptor AcceptorFunc) error {
 	// TODO: don't close all listeners if we're just adding to the list, only
 	// close what we need to.
 	for ipport, lstnr := range s.Listeners {
-		if lstnr != nil {
+		if lstnr.Kind != kind {
+			continue
+		}
+		log.Warn("changing existing listeners on service %s", s.Name)
+		if lstnr.Listener != nil {
 			lstnr.Listener.Close()
 		}
 		delete(s.Listeners, ipport)
@@ -209,6 +445,7 @@ func (s *Service) setListen(value string, acceptor AcceptorFunc) error {
 		ipport = strings.TrimSpace(ipport)
 		log.Debug("creating ServiceListener on %s", ipport)
 		s.Listeners[ipport] = &ServiceListener{
+			Kind:     kind,
 			Listener: nil,
 			Acceptor: acceptor,
 		}
@@ -223,10 +460,101 @@ func (s *Service) setListen(value string, acceptor AcceptorFunc) error {
 // Accept takes an incoming connection from a listener and then passes it down
 // to the appropriate acceptor for whatever our role is.
 func (s *Service) Accept(conn net.Conn, ipport string) error {
+	return s.accept(conn, ipport, s.acceptRole)
+}
+
+// AcceptSpdy is the acceptor for listen_spdy listeners. Clients there speak
+// SPDY from the first byte, though we still do TLS if it's enabled.
+func (s *Service) AcceptSpdy(conn net.Conn, ipport string) error {
+	return s.accept(conn, ipport, s.acceptSpdy)
+}
+
+// accept does the work common to all of our listeners before the connection
+// goes to the given acceptor. That is reading the PROXY header if we expect
+// one, then TLS. Only the trusted proxies may send a header, connections from
+// anywhere else are taken to be straight from the client.
+func (s *Service) accept(conn net.Conn, ipport string, next AcceptorFunc) error {
+	if s.ProxyProtocol && s.proxyTrusted.Contains(conn.RemoteAddr()) {
+		go s.proxyHandshake(conn, ipport, next)
+		return nil
+	}
+	return s.acceptTls(conn, ipport, next)
+}
+
+// proxyHandshake is a goroutine that reads the PROXY header from a new
+// connection, as that can take a while, then carries on accepting it.
+func (s *Service) proxyHandshake(conn net.Conn, ipport string, next AcceptorFunc) {
+	pconn, err := ReadProxyHeader(conn)
+	if err == nil {
+		err = s.acceptTls(pconn, ipport, next)
+	}
+	if err != nil {
+		conn.Close()
+		log.Error("proxyHandshake(%s): %s", conn.RemoteAddr(), err)
+	}
+}
+
+// acceptTls starts the TLS handshake if this service has TLS enabled.
+// Otherwise, the connection goes straight to the acceptor.
+func (s *Service) acceptTls(conn net.Conn, ipport string, next AcceptorFunc) error {
+	if s.tlsConfig != nil {
+		go s.handshake(tls.Server(conn, s.tlsConfig), ipport, next)
+		return nil
+	}
+	return next(conn, ipport)
+}
+
+// handshake is a goroutine that finishes the TLS handshake on a new connection
+// so we know which protocol the client picked. If it didn't pick one we know
+// about, the fallback acceptor gets the connection.
+func (s *Service) handshake(conn *tls.Conn, ipport string, fallback AcceptorFunc) {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := conn.Handshake(); err != nil {
+		log.Debug("handshake(%s): %s", ipport, err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	var err error
+	switch conn.ConnectionState().NegotiatedProtocol {
+	case "spdy/3.1":
+		err = s.acceptSpdy(conn, ipport)
+	case "h2":
+		err = s.acceptHttp2(conn, ipport)
+	default:
+		err = fallback(conn, ipport)
+	}
+	if err != nil {
+		conn.Close()
+		log.Error("handshake(%s): %s", ipport, err)
+	}
+}
+
+// acceptSpdy starts a SPDY session, as long as our role handles requests.
+func (s *Service) acceptSpdy(conn net.Conn, ipport string) error {
+	if s.Role == ROLE_MANAGE || s.Role == ROLE_TCP_PROXY {
+		return errors.New("only HTTP services speak SPDY")
+	}
+	return SpdyAcceptor(conn, s, ipport)
+}
+
+// acceptHttp2 starts an HTTP/2 session, as long as our role handles requests.
+func (s *Service) acceptHttp2(conn net.Conn, ipport string) error {
+	if s.Role == ROLE_MANAGE || s.Role == ROLE_TCP_PROXY {
+		return errors.New("only HTTP services speak HTTP/2")
+	}
+	return Http2Acceptor(conn, s, ipport)
+}
+
+// acceptRole hands a connection to the acceptor for our role.
+func (s *Service) acceptRole(conn net.Conn, ipport string) error {
 	switch s.Role {
 	case ROLE_MANAGE:
 		return TcpAcceptor(conn, s, ipport)
-	case ROLE_PROXY, ROLE_WEBSERVER:
+	case ROLE_TCP_PROXY:
+		return TcpProxyAcceptor(conn, s, ipport)
+	case ROLE_PROXY, ROLE_WEBSERVER, ROLE_SELECTOR, ROLE_ECHO:
 		return HttpAcceptor(conn, s, ipport)
 	default:
 		log.Fatal("unknown role in accept")
@@ -239,7 +567,23 @@ func (s *Service) Accept(conn net.Conn, ipport string) error {
 func (s *Service) Set(key, value string) error {
 	switch key {
 	case "listen":
-		return s.setListen(value, s.Accept)
+		return s.setListen(value, "http", s.Accept)
+	case "listen_spdy":
+		return s.setListen(value, "spdy", s.AcceptSpdy)
+	case "enable_spdy":
+		on, err := ParseBool(value)
+		if err != nil {
+			return err
+		}
+		s.EnableSpdy = on
+	case "enable_http2":
+		on, err := ParseBool(value)
+		if err != nil {
+			return err
+		}
+		s.EnableHttp2 = on
+	case "plugins":
+		return s.setPlugins(value)
 	case "role":
 		switch value {
 		case "web_server":
@@ -248,6 +592,12 @@ func (s *Service) Set(key, value string) error {
 			s.Role = ROLE_MANAGE
 		case "reverse_proxy":
 			s.Role = ROLE_PROXY
+		case "tcp_proxy":
+			s.Role = ROLE_TCP_PROXY
+		case "selector":
+			s.Role = ROLE_SELECTOR
+		case "echo":
+			s.Role = ROLE_ECHO
 		default:
 			return errors.New(fmt.Sprintf("invalid role '%s'", value))
 		}
@@ -262,26 +612,256 @@ func (s *Service) Set(key, value string) error {
 				value))
 		}
 		s.DocRoot = value
+	case "dirindexing":
+		on, err := ParseBool(value)
+		if err != nil {
+			return err
+		}
+		s.DirIndexing = on
+	case "index_files":
+		s.IndexFiles = SplitList(value)
+	case "mime_types_file":
+		types, err := LoadMimeTypes(path.Clean(strings.TrimSpace(value)))
+		if err != nil {
+			return err
+		}
+		s.MimeTypes = types
+	case "default_mime_type":
+		s.DefaultMimeType = strings.TrimSpace(value)
+	case "fd_cache_size":
+		size, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || size < 0 {
+			return errors.New(fmt.Sprintf("invalid fd_cache_size '%s'", value))
+		}
+		s.files.Close()
+		s.files = NewFileCache(size)
+	case "enable_gzip_static":
+		on, err := ParseBool(value)
+		if err != nil {
+			return err
+		}
+		s.GzipStatic = on
+	case "enable_gzip":
+		on, err := ParseBool(value)
+		if err != nil {
+			return err
+		}
+		s.Gzip = on
+	case "gzip_min_length", "gzip_max_length":
+		size, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil || size < 0 {
+			return errors.New(fmt.Sprintf("invalid %s '%s'", key, value))
+		}
+		if key == "gzip_min_length" {
+			s.GzipMinLength = size
+		} else {
+			s.GzipMaxLength = size
+		}
+	case "gzip_types":
+		s.GzipTypes = SplitList(value)
+	case "gzip_cache_maxsize":
+		size, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil || size < 0 {
+			return errors.New(fmt.Sprintf("invalid gzip_cache_maxsize '%s'",
+				value))
+		}
+		s.gzipCache = NewGzipCache(size)
+	case "enable_put":
+		on, err := ParseBool(value)
+		if err != nil {
+			return err
+		}
+		s.EnablePut = on
+	case "enable_delete":
+		on, err := ParseBool(value)
+		if err != nil {
+			return err
+		}
+		s.EnableDelete = on
+	case "min_put_directory":
+		depth, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || depth < 0 {
+			return errors.New(fmt.Sprintf("invalid min_put_directory '%s'",
+				value))
+		}
+		s.MinPutDir = depth
+	case "max_put_size":
+		size, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil || size < 0 {
+			return errors.New(fmt.Sprintf("invalid max_put_size '%s'", value))
+		}
+		s.MaxPutSize = size
+	case "write_allow":
+		list, err := ParseIPList(value)
+		if err != nil {
+			return err
+		}
+		s.writeAllow = list
 	case "pool":
 		pool, ok := pools[value]
 		if !ok {
 			return errors.New(fmt.Sprintf("pool '%s' not found", value))
 		}
 		s.Pool = pool
+	case "persist_backend":
+		on, err := ParseBool(value)
+		if err != nil {
+			return err
+		}
+		s.PersistBackend = on
+	case "upgrade_idle_timeout":
+		secs, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || secs < 0 {
+			return errors.New(fmt.Sprintf("invalid upgrade_idle_timeout '%s'",
+				value))
+		}
+		s.UpgradeIdle = time.Duration(secs) * time.Second
+	case "buffer_uploads":
+		on, err := ParseBool(value)
+		if err != nil {
+			return err
+		}
+		s.BufferUploads = on
+	case "buffer_uploads_path":
+		value = path.Clean(strings.TrimSpace(value))
+		fi, err := os.Stat(value)
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return errors.New(fmt.Sprintf("buffer_uploads_path: %s is not a "+
+				"directory", value))
+		}
+		s.UploadPath = value
+	case "buffer_upload_memory", "max_upload_size":
+		size, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil || size < 0 {
+			return errors.New(fmt.Sprintf("invalid %s '%s'", key, value))
+		}
+		if key == "max_upload_size" {
+			s.MaxUpload = size
+		} else {
+			s.UploadMemory = size
+		}
+	case "enable_reproxy":
+		on, err := ParseBool(value)
+		if err != nil {
+			return err
+		}
+		s.EnableReproxy = on
+	case "reproxy_cache_maxsize":
+		size, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || size < 0 {
+			return errors.New(fmt.Sprintf("invalid reproxy_cache_maxsize '%s'",
+				value))
+		}
+		s.reproxyCache = nil
+		if size > 0 {
+			s.reproxyCache = NewReproxyCache(size)
+		}
+	case "trusted_upstream_proxies":
+		list, err := ParseIPList(value)
+		if err != nil {
+			return err
+		}
+		s.trustedProxies = list
+	case "forwarded_header":
+		on, err := ParseBool(value)
+		if err != nil {
+			return err
+		}
+		s.ForwardedRFC = on
+	case "echo_delay":
+		secs, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || secs < 0 {
+			return errors.New(fmt.Sprintf("invalid echo_delay '%s'", value))
+		}
+		s.EchoDelay = time.Duration(secs * float64(time.Second))
+	case "echo_json":
+		on, err := ParseBool(value)
+		if err != nil {
+			return err
+		}
+		s.EchoJson = on
+	case "tcp_idle_timeout":
+		secs, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || secs < 0 {
+			return errors.New(fmt.Sprintf("invalid tcp_idle_timeout '%s'",
+				value))
+		}
+		s.TcpIdle = time.Duration(secs) * time.Second
+	case "proxy_protocol":
+		on, err := ParseBool(value)
+		if err != nil {
+			return err
+		}
+		s.ProxyProtocol = on
+	case "proxy_protocol_trusted":
+		list, err := ParseIPList(value)
+		if err != nil {
+			return err
+		}
+		s.proxyTrusted = list
+	case "enable_ssl":
+		on, err := ParseBool(value)
+		if err != nil {
+			return err
+		}
+		s.EnableSSL = on
+	case "ssl_cert_file", "ssl_cert":
+		s.sslCertFiles = SplitList(value)
+	case "ssl_key_file", "ssl_key":
+		s.sslKeyFiles = SplitList(value)
+	case "ssl_cert_dir":
+		s.sslCertDir = path.Clean(strings.TrimSpace(value))
+	case "ssl_verify_client":
+		switch value {
+		case "off", "optional", "required":
+			s.sslVerify = value
+		default:
+			return errors.New(fmt.Sprintf("invalid ssl_verify_client '%s'",
+				value))
+		}
+	case "ssl_client_ca_file":
+		s.sslClientCA = path.Clean(strings.TrimSpace(value))
+	case "ssl_client_crl_file":
+		s.sslClientCRL = path.Clean(strings.TrimSpace(value))
+	case "ssl_client_subject_header":
+		s.sslHeaders["subject"] = strings.TrimSpace(value)
+	case "ssl_client_fingerprint_header":
+		s.sslHeaders["fingerprint"] = strings.TrimSpace(value)
+	case "ssl_cipher_list":
+		log.Warn("ssl_cipher_list is not supported, using the Go defaults")
 	default:
+		if strings.Contains(key, ".") {
+			return s.setPluginKey(key, value)
+		}
 		log.Error("unknown SET %s.%s = %s", s.Name, key, value)
 	}
 	return nil
 }
 
-// HandleRequest is a method that takes in an HttpConnection and an http.Request
-// and puts it on our queue to be handled. NOTE: If you are going to return an
+// HandleRequest is a method that takes in a Client and an http.Request and
+// puts it on our queue to be handled. NOTE: If you are going to return an
 // error from this function, you MUST NOT write to the connection. Errors are
 // automatically sent to the user.
-func (s *Service) HandleRequest(conn *HttpConnection, req *http.Request,
+func (s *Service) HandleRequest(conn Client, req *http.Request,
 	rchan chan *http.Response) error {
 
-	// For now, all requests are just enqueued. We could do some work in this
+	// Plugins get the first look, and might answer the request themselves.
+	if resp := s.runStartRequest(req); resp != nil {
+		s.respond(ServiceRequest{client: conn, request: req, rchan: rchan},
+			resp)
+		return nil
+	}
+
+	// Selectors don't handle anything themselves, they pass it on to the
+	// service that does.
+	if s.Role == ROLE_SELECTOR {
+		return s.selectRequest(conn, req, rchan, 0)
+	}
+
+	// For now, all other requests are just enqueued. We could do some work in this
 	// function if we wanted to support blacklisting, delaying requests, or some
 	// other stuff?
 
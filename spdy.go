@@ -9,40 +9,715 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 // SpdySession is the equivalent of a connection to a user. This will contain
 // many streams that are themselves used for making requests.
 type SpdySession struct {
 	Conn      *TcpConnection
+	Service   *Service
 	alive     bool
 	bytesLeft uint32
+
+	// Internal state management variables
+	lock          sync.Mutex
+	cond          *sync.Cond
+	writeLock     sync.Mutex
+	streams       map[uint32]*SpdyStream
+	lastStreamId  uint32
+	initialWindow int32
+	recvWindow    int32
+	goingAway     bool
+	headerReader  SpdyHeaderReader
+	headerWriter  SpdyHeaderWriter
+}
+
+// SpdyStream is a single request and response on a session.
+type SpdyStream struct {
+	Id      uint32
+	Session *SpdySession
+
+	// Internal state management variables, protected by the session lock
+	window     int32
+	recvWindow int32
+	reset      bool
+	body       *spdyBody
+}
+
+// spdyBody is the request body of a stream. Data frames are buffered here by
+// the session and read out by whoever is handling the request. As data is
+// consumed we tell the client it can send more.
+type spdyBody struct {
+	stream *SpdyStream
+	buf    bytes.Buffer
+	done   bool
+	closed bool
+	err    error
 }
 
 //////////////////////////////////////////////////////////////////////////////
 // SpdyConnection base implementation
 //////////////////////////////////////////////////////////////////////////////
 
+// SpdyAcceptor takes a connection from a client that is speaking SPDY and
+// starts up a session on it.
+func SpdyAcceptor(conn net.Conn, svc *Service, ipport string) error {
+	wrap, err := WrapTcpConnection(conn)
+	if err != nil {
+		return err
+	}
+
+	c, err := WrapSpdySession(wrap)
+	if err != nil {
+		return err
+	}
+	c.Service = svc
+
+	go c.pump()
+	return nil
+}
+
 func WrapSpdySession(conn *TcpConnection) (*SpdySession, error) {
 	c := &SpdySession{
-		Conn:  conn,
-		alive: true,
+		Conn:          conn,
+		alive:         true,
+		bytesLeft:     SPDY_DEFAULT_WINDOW,
+		streams:       make(map[uint32]*SpdyStream),
+		initialWindow: SPDY_DEFAULT_WINDOW,
+		recvWindow:    SPDY_DEFAULT_WINDOW,
 	}
+	c.cond = sync.NewCond(&c.lock)
 
 	return c, nil
 }
 
+// pump reads frames from the client and dispatches them. Each new stream is
+// handed off to its own goroutine, so this never blocks on a request.
+func (c *SpdySession) pump() {
+	defer c.Close()
+
+	// Let the client know how many streams we're willing to have open.
+	var settings [12]byte
+	binary.BigEndian.PutUint32(settings[0:4], 1)
+	binary.BigEndian.PutUint32(settings[4:8], SPDY_SETTINGS_MAX_CONCURRENT_STREAMS)
+	binary.BigEndian.PutUint32(settings[8:12], 100)
+	if err := c.writeControl(SPDY_SETTINGS, 0, settings[:]); err != nil {
+		return
+	}
+
+	for {
+		f, err := ReadSpdyFrame(c.Conn.BReader)
+		if err != nil {
+			if err != io.EOF {
+				log.Error("SpdySession: %s", err)
+			}
+			return
+		}
+
+		if !f.Control {
+			if err := c.handleData(f); err != nil {
+				log.Error("SpdySession: %s", err)
+				c.goAway(SPDY_GOAWAY_PROTOCOL_ERROR)
+				return
+			}
+			continue
+		}
+
+		switch f.Type {
+		case SPDY_SYN_STREAM:
+			err = c.handleSynStream(f)
+		case SPDY_RST_STREAM:
+			c.handleRstStream(f)
+		case SPDY_SETTINGS:
+			c.handleSettings(f)
+		case SPDY_PING:
+			err = c.handlePing(f)
+		case SPDY_GOAWAY:
+			c.lock.Lock()
+			c.goingAway = true
+			c.lock.Unlock()
+		case SPDY_HEADERS:
+			// Trailing headers from the client. We have nowhere to put
+			// these, but they do have to go through the decompressor.
+			if len(f.Data) >= 4 {
+				_, err = c.headerReader.Decode(f.Data[4:])
+			}
+		case SPDY_WINDOW_UPDATE:
+			err = c.handleWindowUpdate(f)
+		default:
+			log.Debug("SpdySession: ignoring frame type %d", f.Type)
+		}
+		if err != nil {
+			log.Error("SpdySession: %s", err)
+			c.goAway(SPDY_GOAWAY_PROTOCOL_ERROR)
+			return
+		}
+	}
+}
+
+// handleSynStream starts a new stream and the request that goes with it.
+func (c *SpdySession) handleSynStream(f *SpdyFrame) error {
+	if len(f.Data) < 10 {
+		return errors.New("short SYN_STREAM")
+	}
+
+	// We have to decompress the headers even if we refuse the stream, or the
+	// zlib context gets out of sync.
+	hdr, err := c.headerReader.Decode(f.Data[10:])
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	if f.StreamId <= c.lastStreamId || f.StreamId%2 == 0 {
+		c.lock.Unlock()
+		return errors.New(fmt.Sprintf("invalid stream id %d", f.StreamId))
+	}
+	c.lastStreamId = f.StreamId
+	if c.goingAway {
+		c.lock.Unlock()
+		return c.writeRst(f.StreamId, SPDY_REFUSED_STREAM)
+	}
+
+	st := &SpdyStream{
+		Id:         f.StreamId,
+		Session:    c,
+		window:     c.initialWindow,
+		recvWindow: SPDY_DEFAULT_WINDOW,
+	}
+	if f.Flags&SPDY_FLAG_FIN == 0 {
+		st.body = &spdyBody{stream: st}
+	}
+	c.streams[st.Id] = st
+	c.lock.Unlock()
+
+	req, err := st.buildRequest(hdr)
+	if err != nil {
+		log.Error("SpdySession: stream %d: %s", st.Id, err)
+		st.Close()
+		return nil
+	}
+
+	go st.serve(req)
+	return nil
+}
+
+// handleData puts the contents of a data frame into the stream's body. The
+// client can only send as much as the windows we've given it allow; going
+// over on a stream resets it, going over on the session is an error.
+func (c *SpdySession) handleData(f *SpdyFrame) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	n := int32(len(f.Data))
+	c.recvWindow -= n
+	if c.recvWindow < 0 {
+		return errors.New("client overran the session window")
+	}
+
+	st, ok := c.streams[f.StreamId]
+	if !ok || st.body == nil || st.body.done {
+		// Stream is gone or shouldn't be sending. Let the client know, but we
+		// still credit the session window so that other streams can go on.
+		go c.writeRst(f.StreamId, SPDY_INVALID_STREAM)
+		c.creditWindow(nil, n)
+		return nil
+	}
+
+	st.recvWindow -= n
+	if st.recvWindow < 0 {
+		log.Warn("SpdySession: stream %d overran its window", st.Id)
+		st.reset = true
+		c.dropStream(st, errors.New("stream flow control error"))
+		c.creditWindow(nil, n)
+		go c.writeRst(st.Id, SPDY_FLOW_CONTROL_ERROR)
+		return nil
+	}
+
+	if st.body.closed {
+		// Nobody is going to read this.
+		c.creditWindow(nil, n)
+	} else {
+		st.body.buf.Write(f.Data)
+	}
+	if f.Flags&SPDY_FLAG_FIN != 0 {
+		st.body.done = true
+	}
+	c.cond.Broadcast()
+	return nil
+}
+
+// handleRstStream cancels a stream at the client's request.
+func (c *SpdySession) handleRstStream(f *SpdyFrame) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if st, ok := c.streams[f.StreamId]; ok {
+		st.reset = true
+		c.dropStream(st, errors.New("stream reset by client"))
+	}
+}
+
+// handleSettings applies the settings the client sends us. The only one
+// that matters to us is the initial window, which also adjusts the window of
+// every open stream.
+func (c *SpdySession) handleSettings(f *SpdyFrame) {
+	if len(f.Data) < 4 {
+		return
+	}
+	count := binary.BigEndian.Uint32(f.Data[0:4])
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for i := uint32(0); i < count && int(8*i+12) <= len(f.Data); i++ {
+		entry := f.Data[4+8*i : 12+8*i]
+		id := binary.BigEndian.Uint32(entry[0:4]) & 0xffffff
+		value := int32(binary.BigEndian.Uint32(entry[4:8]))
+		if id != SPDY_SETTINGS_INITIAL_WINDOW_SIZE {
+			continue
+		}
+
+		delta := value - c.initialWindow
+		c.initialWindow = value
+		for _, st := range c.streams {
+			st.window += delta
+		}
+	}
+	c.cond.Broadcast()
+}
+
+// handlePing answers pings from the client. Client pings have odd ids; even
+// ones would be answers to pings we sent, and we don't send any.
+func (c *SpdySession) handlePing(f *SpdyFrame) error {
+	if len(f.Data) != 4 {
+		return errors.New("bad PING")
+	}
+	if binary.BigEndian.Uint32(f.Data)%2 == 0 {
+		return nil
+	}
+	return c.writeControl(SPDY_PING, 0, f.Data)
+}
+
+// handleWindowUpdate lets us send more data on a stream, or on the session
+// as a whole if it's for stream 0. No window may go over SPDY_MAX_WINDOW;
+// a stream that would is reset, and a session that would is an error.
+func (c *SpdySession) handleWindowUpdate(f *SpdyFrame) error {
+	if len(f.Data) < 8 {
+		return nil
+	}
+	delta := binary.BigEndian.Uint32(f.Data[4:8]) & 0x7fffffff
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if f.StreamId == 0 {
+		if uint64(c.bytesLeft)+uint64(delta) > SPDY_MAX_WINDOW {
+			return errors.New("client overflowed the session window")
+		}
+		c.bytesLeft += delta
+	} else if st, ok := c.streams[f.StreamId]; ok {
+		if int64(st.window)+int64(delta) > SPDY_MAX_WINDOW {
+			log.Warn("SpdySession: stream %d window overflowed", st.Id)
+			st.reset = true
+			c.dropStream(st, errors.New("stream flow control error"))
+			go c.writeRst(st.Id, SPDY_FLOW_CONTROL_ERROR)
+		} else {
+			st.window += int32(delta)
+		}
+	}
+	c.cond.Broadcast()
+	return nil
+}
+
+// reserveWindow blocks until we are allowed to send some data on a stream,
+// then takes up to want bytes from the stream and session windows.
+func (c *SpdySession) reserveWindow(st *SpdyStream, want int) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for c.alive && !st.reset && (c.bytesLeft == 0 || st.window <= 0) {
+		c.cond.Wait()
+	}
+	if !c.alive {
+		return 0, errors.New("session closed")
+	} else if st.reset {
+		return 0, errors.New("stream reset")
+	}
+
+	n := want
+	if uint32(n) > c.bytesLeft {
+		n = int(c.bytesLeft)
+	}
+	if int32(n) > st.window {
+		n = int(st.window)
+	}
+	c.bytesLeft -= uint32(n)
+	st.window -= int32(n)
+	return n, nil
+}
+
+// endStream forgets about a stream once we've sent our side of it.
+func (c *SpdySession) endStream(st *SpdyStream) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.dropStream(st, errors.New("stream closed"))
+}
+
+// dropStream forgets about a stream. Whatever the client sent on it that
+// nobody read is given back to the session window, or the other streams would
+// eventually starve. The lock must be held.
+func (c *SpdySession) dropStream(st *SpdyStream, err error) {
+	delete(c.streams, st.Id)
+	if b := st.body; b != nil {
+		if !b.done && b.err == nil {
+			b.err = err
+		}
+		c.creditWindow(nil, int32(b.buf.Len()))
+		b.buf.Reset()
+		b.closed = true
+	}
+	c.cond.Broadcast()
+}
+
+// creditWindow lets the client send n more bytes on the session, and on a
+// stream if one is given. The lock must be held, so the updates are sent in
+// the background.
+func (c *SpdySession) creditWindow(st *SpdyStream, n int32) {
+	if n <= 0 {
+		return
+	}
+	c.recvWindow += n
+	go c.writeWindowUpdate(0, uint32(n))
+	if st != nil {
+		st.recvWindow += n
+		go c.writeWindowUpdate(st.Id, uint32(n))
+	}
+}
+
+// writeControl sends a control frame, taking care of the locking.
+func (c *SpdySession) writeControl(ftype uint16, flags uint8, data []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if err := WriteSpdyControl(c.Conn.BWriter, ftype, flags, data); err != nil {
+		return err
+	}
+	return c.Conn.BWriter.Flush()
+}
+
+// writeHeaders compresses and sends a SYN_REPLY or HEADERS frame. This has to
+// hold the write lock while compressing so that blocks go out in order.
+func (c *SpdySession) writeHeaders(ftype uint16, id uint32, flags uint8,
+	hdr http.Header) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	block, err := c.headerWriter.Encode(hdr)
+	if err != nil {
+		return err
+	}
+	data := make([]byte, 4, 4+len(block))
+	binary.BigEndian.PutUint32(data, id)
+	data = append(data, block...)
+
+	if err := WriteSpdyControl(c.Conn.BWriter, ftype, flags, data); err != nil {
+		return err
+	}
+	return c.Conn.BWriter.Flush()
+}
+
+// writeData sends a data frame.
+func (c *SpdySession) writeData(id uint32, flags uint8, data []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if err := WriteSpdyData(c.Conn.BWriter, id, flags, data); err != nil {
+		return err
+	}
+	return c.Conn.BWriter.Flush()
+}
+
+// writeRst tells the client we're giving up on a stream.
+func (c *SpdySession) writeRst(id, status uint32) error {
+	var data [8]byte
+	binary.BigEndian.PutUint32(data[0:4], id)
+	binary.BigEndian.PutUint32(data[4:8], status)
+	return c.writeControl(SPDY_RST_STREAM, 0, data[:])
+}
+
+// writeWindowUpdate lets the client send more data.
+func (c *SpdySession) writeWindowUpdate(id, delta uint32) error {
+	var data [8]byte
+	binary.BigEndian.PutUint32(data[0:4], id)
+	binary.BigEndian.PutUint32(data[4:8], delta)
+	return c.writeControl(SPDY_WINDOW_UPDATE, 0, data[:])
+}
+
+// goAway tells the client we won't be accepting any more streams.
+func (c *SpdySession) goAway(status uint32) error {
+	c.lock.Lock()
+	c.goingAway = true
+	last := c.lastStreamId
+	c.lock.Unlock()
+
+	var data [8]byte
+	binary.BigEndian.PutUint32(data[0:4], last)
+	binary.BigEndian.PutUint32(data[4:8], status)
+	return c.writeControl(SPDY_GOAWAY, 0, data[:])
+}
+
+// RemoteAddr is the address of the client on the other end of the session.
+func (c *SpdySession) RemoteAddr() net.Addr {
+	return c.Conn.Conn.RemoteAddr()
+}
+
+// LocalAddr is the address the client connected to.
+func (c *SpdySession) LocalAddr() net.Addr {
+	return c.Conn.Conn.LocalAddr()
+}
+
 // Close on a SPDY session. This should be gentle and tell the user that we're
 // cutting them off.
 func (c *SpdySession) Close() error {
+	c.lock.Lock()
 	if !c.alive {
+		c.lock.Unlock()
 		return errors.New("SpdySession already closed")
 	}
 	c.alive = false
+	for _, st := range c.streams {
+		if st.body != nil && !st.body.done {
+			st.body.err = errors.New("session closed")
+		}
+	}
+	c.cond.Broadcast()
+	c.lock.Unlock()
 
-	// TODO: send GOAWAY frame and close gently.
+	if err := c.goAway(SPDY_GOAWAY_OK); err != nil {
+		log.Debug("SpdySession: failed to send GOAWAY: %s", err)
+	}
 
 	log.Debug("SpdySession closing")
 	return c.Conn.Close()
 }
+
+//////////////////////////////////////////////////////////////////////////////
+// SpdyStream implementation
+//////////////////////////////////////////////////////////////////////////////
+
+// buildRequest turns the headers from a SYN_STREAM into an http.Request that
+// a Service can handle like any other.
+func (st *SpdyStream) buildRequest(hdr http.Header) (*http.Request, error) {
+	method := hdr.Get(":method")
+	path := hdr.Get(":path")
+	version := hdr.Get(":version")
+	if method == "" || path == "" || version == "" {
+		return nil, errors.New("missing required headers")
+	}
+
+	major, minor, ok := http.ParseHTTPVersion(version)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("bad version '%s'", version))
+	}
+	u, err := url.ParseRequestURI(path)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method:        method,
+		URL:           u,
+		Proto:         version,
+		ProtoMajor:    major,
+		ProtoMinor:    minor,
+		Header:        make(http.Header),
+		Host:          hdr.Get(":host"),
+		RequestURI:    path,
+		RemoteAddr:    st.Session.RemoteAddr().String(),
+		ContentLength: 0,
+		Body:          http.NoBody,
+	}
+	for name, values := range hdr {
+		if strings.HasPrefix(name, ":") || spdyHopHeaders[name] {
+			continue
+		}
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+
+	if st.body != nil {
+		req.Body = st.body
+		req.ContentLength = -1
+		if cl := req.Header.Get("Content-Length"); cl != "" {
+			if n, err := strconv.ParseInt(cl, 10, 64); err == nil {
+				req.ContentLength = n
+			}
+		}
+	}
+
+	req.TLS = TlsState(st.Session.Conn.Conn)
+	if st.Session.Service.ClientAuth != nil {
+		st.Session.Service.ClientAuth.SetIdentity(st.Session.Conn.Conn, req)
+	}
+	return req, nil
+}
+
+// serve is a goroutine that runs a request through the service and sends
+// the response back to the client.
+func (st *SpdyStream) serve(req *http.Request) {
+	defer st.Session.endStream(st)
+
+	rchan := make(chan *http.Response, 1)
+	var resp *http.Response
+	if err := st.Session.Service.HandleRequest(st, req, rchan); err != nil {
+		resp = HttpErrorResponse(req, err)
+	} else {
+		resp = <-rchan
+	}
+
+	err := st.WriteResponse(resp)
+	if resp.Body != nil {
+		resp.Body.Close()
+	}
+	if err != nil {
+		log.Error("SpdyStream %d: %s", st.Id, err)
+		st.Close()
+	}
+}
+
+// WriteResponse sends the response headers in a SYN_REPLY followed by the
+// body in data frames, respecting the flow control windows.
+func (st *SpdyStream) WriteResponse(resp *http.Response) error {
+	hdr := make(http.Header)
+	for name, values := range resp.Header {
+		if !spdyHopHeaders[strings.ToLower(name)] {
+			hdr[strings.ToLower(name)] = values
+		}
+	}
+	hdr[":status"] = []string{fmt.Sprintf("%d %s", resp.StatusCode,
+		http.StatusText(resp.StatusCode))}
+	hdr[":version"] = []string{"HTTP/1.1"}
+	if resp.ContentLength >= 0 {
+		hdr["content-length"] = []string{strconv.FormatInt(resp.ContentLength, 10)}
+	}
+
+	if resp.Body == nil || resp.ContentLength == 0 {
+		return st.Session.writeHeaders(SPDY_SYN_REPLY, st.Id, SPDY_FLAG_FIN, hdr)
+	}
+	if err := st.Session.writeHeaders(SPDY_SYN_REPLY, st.Id, 0, hdr); err != nil {
+		return err
+	}
+
+	buf := make([]byte, SPDY_MAX_DATA)
+	for {
+		n, err := resp.Body.Read(buf)
+		for sent := 0; sent < n; {
+			allowed, werr := st.Session.reserveWindow(st, n-sent)
+			if werr != nil {
+				return werr
+			}
+			if werr = st.Session.writeData(st.Id, 0, buf[sent:sent+allowed]); werr != nil {
+				return werr
+			}
+			sent += allowed
+		}
+		if err == io.EOF {
+			return st.Session.writeData(st.Id, SPDY_FLAG_FIN, nil)
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// RemoteAddr is the address of the client that opened this stream.
+func (st *SpdyStream) RemoteAddr() net.Addr {
+	return st.Session.RemoteAddr()
+}
+
+// LocalAddr is the address the client connected to.
+func (st *SpdyStream) LocalAddr() net.Addr {
+	return st.Session.LocalAddr()
+}
+
+// Close cancels the stream. The rest of the session is unaffected.
+func (st *SpdyStream) Close() error {
+	c := st.Session
+	c.lock.Lock()
+	if _, ok := c.streams[st.Id]; !ok {
+		c.lock.Unlock()
+		return nil
+	}
+	st.reset = true
+	c.dropStream(st, errors.New("stream cancelled"))
+	c.lock.Unlock()
+
+	return c.writeRst(st.Id, SPDY_CANCEL)
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// spdyBody implementation
+//////////////////////////////////////////////////////////////////////////////
+
+// Read blocks until there is body data to hand out, then credits the stream
+// and session windows so that the client can send more.
+func (b *spdyBody) Read(p []byte) (int, error) {
+	c := b.stream.Session
+	c.lock.Lock()
+	for b.buf.Len() == 0 && !b.done && b.err == nil {
+		c.cond.Wait()
+	}
+	if b.err != nil {
+		c.lock.Unlock()
+		return 0, b.err
+	}
+	if b.buf.Len() == 0 && b.done {
+		c.lock.Unlock()
+		return 0, io.EOF
+	}
+	n, _ := b.buf.Read(p)
+	done := b.done
+	c.recvWindow += int32(n)
+	if !done {
+		b.stream.recvWindow += int32(n)
+	}
+	c.lock.Unlock()
+
+	c.writeWindowUpdate(0, uint32(n))
+	if !done {
+		c.writeWindowUpdate(b.stream.Id, uint32(n))
+	}
+	return n, nil
+}
+
+// Close on the body stops us caring about any more data. What we had buffered
+// is given back to the session window, as is anything that arrives later.
+func (b *spdyBody) Close() error {
+	c := b.stream.Session
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !b.closed {
+		b.closed = true
+		if b.err == nil {
+			b.err = errors.New("body closed")
+		}
+		c.creditWindow(nil, int32(b.buf.Len()))
+		b.buf.Reset()
+		c.cond.Broadcast()
+	}
+	return nil
+}
@@ -0,0 +1,302 @@
+/*
+	gobal - spdy_frame.go
+
+	Reading and writing SPDY/3.1 frames, including the zlib compressed header
+	blocks.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	SPDY_VERSION = 3
+
+	// Control frame types.
+	SPDY_SYN_STREAM    = 1
+	SPDY_SYN_REPLY     = 2
+	SPDY_RST_STREAM    = 3
+	SPDY_SETTINGS      = 4
+	SPDY_PING          = 6
+	SPDY_GOAWAY        = 7
+	SPDY_HEADERS       = 8
+	SPDY_WINDOW_UPDATE = 9
+
+	// Frame flags.
+	SPDY_FLAG_FIN            = 0x01
+	SPDY_FLAG_UNIDIRECTIONAL = 0x02
+
+	// RST_STREAM status codes.
+	SPDY_PROTOCOL_ERROR        = 1
+	SPDY_INVALID_STREAM        = 2
+	SPDY_REFUSED_STREAM        = 3
+	SPDY_CANCEL                = 5
+	SPDY_INTERNAL_ERROR        = 6
+	SPDY_FLOW_CONTROL_ERROR    = 7
+	SPDY_STREAM_IN_USE         = 8
+	SPDY_STREAM_ALREADY_CLOSED = 9
+
+	// GOAWAY status codes.
+	SPDY_GOAWAY_OK             = 0
+	SPDY_GOAWAY_PROTOCOL_ERROR = 1
+	SPDY_GOAWAY_INTERNAL_ERROR = 2
+
+	// SETTINGS ids that we care about.
+	SPDY_SETTINGS_MAX_CONCURRENT_STREAMS = 4
+	SPDY_SETTINGS_INITIAL_WINDOW_SIZE    = 7
+
+	SPDY_DEFAULT_WINDOW = 65536
+	SPDY_MAX_WINDOW     = 0x7fffffff
+	SPDY_MAX_DATA       = 16384
+
+	// The most a header block may decompress to, names, values and lengths
+	// all counted. It's the same as net/http allows for HTTP/1.1.
+	SPDY_MAX_HEADER_BLOCK = 1 << 20
+)
+
+// SpdyFrame is a single frame off the wire. For data frames, StreamId is set
+// and Type is zero. For control frames, the payload still contains the
+// stream id (if any) as the layout differs between types.
+type SpdyFrame struct {
+	Control  bool
+	Type     uint16
+	StreamId uint32
+	Flags    uint8
+	Data     []byte
+}
+
+// spdyDictionaryWords and spdyDictionaryTail make up the zlib dictionary from
+// the SPDY/3 specification. The words are each prefixed with their length.
+var spdyDictionaryWords = []string{
+	"options", "head", "post", "put", "delete", "trace", "accept",
+	"accept-charset", "accept-encoding", "accept-language", "accept-ranges",
+	"age", "allow", "authorization", "cache-control", "connection",
+	"content-base", "content-encoding", "content-language", "content-length",
+	"content-location", "content-md5", "content-range", "content-type", "date",
+	"etag", "expect", "expires", "from", "host", "if-match",
+	"if-modified-since", "if-none-match", "if-range", "if-unmodified-since",
+	"last-modified", "location", "max-forwards", "pragma",
+	"proxy-authenticate", "proxy-authorization", "range", "referer",
+	"retry-after", "server", "te", "trailer", "transfer-encoding", "upgrade",
+	"user-agent", "vary", "via", "warning", "www-authenticate", "method", "get",
+	"status", "200 OK", "version", "HTTP/1.1", "url", "public", "set-cookie",
+	"keep-alive", "origin",
+}
+
+const spdyDictionaryTail = "100101201202205206300302303304305306307402405406407" +
+	"408409410411412413414415416417502504505203 Non-Authoritative Information" +
+	"204 No Content301 Moved Permanently400 Bad Request401 Unauthorized403 " +
+	"Forbidden404 Not Found500 Internal Server Error501 Not Implemented503 " +
+	"Service UnavailableJan Feb Mar Apr May Jun Jul Aug Sept Oct Nov Dec " +
+	"00:00:00 Mon, Tue, Wed, Thu, Fri, Sat, Sun, GMTchunked,text/html," +
+	"image/png,image/jpg,image/gif,application/xml,application/xhtml+xml," +
+	"text/plain,text/javascript,publicprivatemax-age=gzip,deflate,sdch" +
+	"charset=utf-8charset=iso-8859-1,utf-,*,enq=0."
+
+var spdyDictionary []byte
+
+func init() {
+	var buf bytes.Buffer
+	for _, word := range spdyDictionaryWords {
+		binary.Write(&buf, binary.BigEndian, uint32(len(word)))
+		buf.WriteString(word)
+	}
+	buf.WriteString(spdyDictionaryTail)
+	spdyDictionary = buf.Bytes()
+}
+
+// spdyHopHeaders are not allowed in SPDY responses.
+var spdyHopHeaders = map[string]bool{
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// Frame reading and writing
+//////////////////////////////////////////////////////////////////////////////
+
+// ReadSpdyFrame pulls the next frame off of a connection.
+func ReadSpdyFrame(r io.Reader) (*SpdyFrame, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	f := &SpdyFrame{}
+	first := binary.BigEndian.Uint32(hdr[0:4])
+	if first&0x80000000 != 0 {
+		f.Control = true
+		if version := (first >> 16) & 0x7fff; version != SPDY_VERSION {
+			return nil, errors.New(fmt.Sprintf("unsupported SPDY version %d",
+				version))
+		}
+		f.Type = uint16(first & 0xffff)
+	} else {
+		f.StreamId = first & 0x7fffffff
+	}
+
+	second := binary.BigEndian.Uint32(hdr[4:8])
+	f.Flags = uint8(second >> 24)
+	f.Data = make([]byte, second&0xffffff)
+	if _, err := io.ReadFull(r, f.Data); err != nil {
+		return nil, err
+	}
+
+	// Most control frames start with a stream id, so save everyone the work.
+	if f.Control && len(f.Data) >= 4 {
+		switch f.Type {
+		case SPDY_SYN_STREAM, SPDY_SYN_REPLY, SPDY_RST_STREAM, SPDY_HEADERS,
+			SPDY_WINDOW_UPDATE:
+			f.StreamId = binary.BigEndian.Uint32(f.Data[0:4]) & 0x7fffffff
+		}
+	}
+	return f, nil
+}
+
+// WriteSpdyControl writes a control frame to the given writer.
+func WriteSpdyControl(w io.Writer, ftype uint16, flags uint8, data []byte) error {
+	var hdr [8]byte
+	binary.BigEndian.PutUint32(hdr[0:4], 0x80000000|SPDY_VERSION<<16|uint32(ftype))
+	binary.BigEndian.PutUint32(hdr[4:8], uint32(flags)<<24|uint32(len(data)))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// WriteSpdyData writes a data frame to the given writer.
+func WriteSpdyData(w io.Writer, id uint32, flags uint8, data []byte) error {
+	var hdr [8]byte
+	binary.BigEndian.PutUint32(hdr[0:4], id&0x7fffffff)
+	binary.BigEndian.PutUint32(hdr[4:8], uint32(flags)<<24|uint32(len(data)))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// Header compression
+//////////////////////////////////////////////////////////////////////////////
+
+// SpdyHeaderReader decompresses header blocks. The zlib context is shared by
+// every block on a session, so there must be exactly one per session and
+// blocks must be fed in the order they were received.
+type SpdyHeaderReader struct {
+	buf  bytes.Buffer
+	zlib io.ReadCloser
+}
+
+// Decode decompresses a header block into a map of lowercase names to values.
+// Values that were NUL separated come back as several entries.
+func (hr *SpdyHeaderReader) Decode(block []byte) (http.Header, error) {
+	hr.buf.Write(block)
+	if hr.zlib == nil {
+		zr, err := zlib.NewReaderDict(&hr.buf, spdyDictionary)
+		if err != nil {
+			return nil, err
+		}
+		hr.zlib = zr
+	}
+
+	// We must never read past the end of what's in the buffer, as the zlib
+	// reader would treat that as a fatal error. A small block can inflate to
+	// something huge, so what it inflates to is limited too.
+	var count uint32
+	if err := binary.Read(hr.zlib, binary.BigEndian, &count); err != nil {
+		return nil, err
+	}
+
+	left := SPDY_MAX_HEADER_BLOCK - 4
+	hdr := make(http.Header)
+	for i := uint32(0); i < count; i++ {
+		name, err := hr.readString(&left)
+		if err != nil {
+			return nil, err
+		}
+		value, err := hr.readString(&left)
+		if err != nil {
+			return nil, err
+		}
+		name = strings.ToLower(name)
+		for _, v := range strings.Split(value, "\x00") {
+			hdr[name] = append(hdr[name], v)
+		}
+	}
+	return hdr, nil
+}
+
+// readString reads a length prefixed string out of the header block, taking
+// what it reads from the bytes left for the block.
+func (hr *SpdyHeaderReader) readString(left *int) (string, error) {
+	if *left < 4 {
+		return "", errors.New("header block too large")
+	}
+	var size uint32
+	if err := binary.Read(hr.zlib, binary.BigEndian, &size); err != nil {
+		return "", err
+	}
+	if *left -= 4; size > uint32(*left) {
+		return "", errors.New("header block too large")
+	}
+	*left -= int(size)
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(hr.zlib, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// SpdyHeaderWriter compresses header blocks. Like the reader, there is one
+// of these per session and blocks must be sent in the order they were made.
+type SpdyHeaderWriter struct {
+	buf  bytes.Buffer
+	zlib *zlib.Writer
+}
+
+// Encode builds a compressed header block. Names are lowercased as SPDY
+// requires, and multiple values for a name are NUL separated.
+func (hw *SpdyHeaderWriter) Encode(hdr http.Header) ([]byte, error) {
+	if hw.zlib == nil {
+		zw, err := zlib.NewWriterLevelDict(&hw.buf, zlib.DefaultCompression,
+			spdyDictionary)
+		if err != nil {
+			return nil, err
+		}
+		hw.zlib = zw
+	}
+
+	var raw bytes.Buffer
+	binary.Write(&raw, binary.BigEndian, uint32(len(hdr)))
+	for name, values := range hdr {
+		value := strings.Join(values, "\x00")
+		binary.Write(&raw, binary.BigEndian, uint32(len(name)))
+		raw.WriteString(strings.ToLower(name))
+		binary.Write(&raw, binary.BigEndian, uint32(len(value)))
+		raw.WriteString(value)
+	}
+
+	hw.buf.Reset()
+	if _, err := hw.zlib.Write(raw.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := hw.zlib.Flush(); err != nil {
+		return nil, err
+	}
+	return append([]byte{}, hw.buf.Bytes()...), nil
+}
@@ -0,0 +1,138 @@
+/*
+	gobal - spdy_frame_test.go
+
+	Tests for reading and writing SPDY frames and header blocks.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSpdyControlFrame(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteSpdyControl(&buf, SPDY_PING, SPDY_FLAG_FIN,
+		[]byte{0, 0, 0, 7}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte{0x80, 0x03, 0x00, 0x06, 0x01, 0x00, 0x00, 0x04,
+		0, 0, 0, 7}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("wrote %x; want %x", buf.Bytes(), want)
+	}
+
+	f, err := ReadSpdyFrame(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Control || f.Type != SPDY_PING || f.Flags != SPDY_FLAG_FIN ||
+		!bytes.Equal(f.Data, []byte{0, 0, 0, 7}) {
+		t.Errorf("read %+v", f)
+	}
+}
+
+func TestSpdyDataFrame(t *testing.T) {
+	var buf bytes.Buffer
+	// The top bit of the stream id marks control frames, so it's dropped.
+	if err := WriteSpdyData(&buf, 0x80000005, 0, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ReadSpdyFrame(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Control || f.StreamId != 5 || f.Flags != 0 ||
+		string(f.Data) != "hello" {
+		t.Errorf("read %+v", f)
+	}
+}
+
+func TestSpdyFrameErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"short header", []byte{0x80, 0x03, 0x00}},
+		{"short payload", []byte{0x80, 0x03, 0x00, 0x06, 0x00, 0x00, 0x00,
+			0x04, 0, 0}},
+		{"version 2", []byte{0x80, 0x02, 0x00, 0x06, 0x00, 0x00, 0x00, 0x00}},
+	}
+
+	for _, test := range tests {
+		if f, err := ReadSpdyFrame(bytes.NewReader(test.data)); err == nil {
+			t.Errorf("%s: read %+v; want an error", test.name, f)
+		}
+	}
+}
+
+func TestSpdyHeaderBlocks(t *testing.T) {
+	blocks := []http.Header{
+		{
+			":method":  {"GET"},
+			":path":    {"/index.html"},
+			":version": {"HTTP/1.1"},
+			"Accept":   {"text/html"},
+		},
+		// The second block depends on the zlib state left by the first.
+		{
+			":status":    {"200 OK"},
+			"set-cookie": {"a=1", "b=2"},
+		},
+	}
+
+	var hw SpdyHeaderWriter
+	var hr SpdyHeaderReader
+	var encoded [][]byte
+	for _, hdr := range blocks {
+		block, err := hw.Encode(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded = append(encoded, block)
+	}
+
+	for i, block := range encoded {
+		got, err := hr.Decode(block)
+		if err != nil {
+			t.Fatalf("block %d: %s", i, err)
+		}
+
+		// Names come back lowercased, and several values stay separate.
+		want := make(http.Header)
+		for name, values := range blocks[i] {
+			want[strings.ToLower(name)] = values
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("block %d: got %v; want %v", i, got, want)
+		}
+	}
+}
+
+func TestSpdyHeaderBlockLimit(t *testing.T) {
+	// This compresses to next to nothing, but mustn't be inflated in full.
+	var hw SpdyHeaderWriter
+	block, err := hw.Encode(http.Header{
+		"X-Big": {strings.Repeat("a", SPDY_MAX_HEADER_BLOCK)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(block) > SPDY_MAX_HEADER_BLOCK/100 {
+		t.Fatalf("block of %d bytes didn't compress", len(block))
+	}
+
+	var hr SpdyHeaderReader
+	if hdr, err := hr.Decode(block); err == nil {
+		t.Errorf("decoded %d bytes of headers", len(hdr.Get("x-big")))
+	}
+}
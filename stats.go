@@ -0,0 +1,120 @@
+/*
+	gobal - stats.go
+
+	Counters for what our services are doing, and the access log. The counters
+	can be seen on the management port with SHOW STATS.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// ServiceStats is a set of named counters for a service. Names are free form,
+// such as "requests" or "status.200", so new counters need no setup.
+type ServiceStats struct {
+	lock     sync.Mutex
+	counters map[string]int64
+}
+
+// statsBody wraps the body of a response so that we can log the request once
+// the response has been sent. This is also when gRPC trailers are available.
+// What the client was sent is counted in bytes_out.
+type statsBody struct {
+	io.ReadCloser
+	stats  *ServiceStats
+	done   func()
+	sent   int64
+	closed bool
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// ServiceStats implementation
+//////////////////////////////////////////////////////////////////////////////
+
+// NewServiceStats returns an empty set of counters.
+func NewServiceStats() *ServiceStats {
+	return &ServiceStats{
+		counters: make(map[string]int64),
+	}
+}
+
+// Add changes a counter by some amount. Counters start at zero.
+func (st *ServiceStats) Add(name string, delta int64) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.counters[name] += delta
+}
+
+// Get returns the current value of a counter.
+func (st *ServiceStats) Get(name string) int64 {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	return st.counters[name]
+}
+
+// Names returns the names of all of our counters, sorted.
+func (st *ServiceStats) Names() []string {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	names := make([]string, 0, len(st.counters))
+	for name := range st.counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// Access logging
+//////////////////////////////////////////////////////////////////////////////
+
+// logRequest counts a finished request and writes it to the access log. For
+// gRPC calls, this includes the grpc-status.
+func (s *Service) logRequest(req ServiceRequest, resp *http.Response) {
+	s.Stats.Add("requests", 1)
+	s.Stats.Add(fmt.Sprintf("status.%d", resp.StatusCode), 1)
+
+	grpcStatus := "-"
+	if IsGrpcRequest(req.request) {
+		if grpcStatus = GrpcStatus(resp); grpcStatus == "" {
+			grpcStatus = "-"
+		}
+		s.Stats.Add("grpc.requests", 1)
+		s.Stats.Add("grpc.status."+grpcStatus, 1)
+	}
+
+	client := "-"
+	if req.client != nil {
+		client = req.client.RemoteAddr().String()
+	}
+	log.Info("access: %s %s \"%s %s %s\" %d %s", s.Name, client,
+		req.request.Method, req.request.RequestURI, req.request.Proto,
+		resp.StatusCode, grpcStatus)
+}
+
+// Read counts what goes through on its way to the client.
+func (b *statsBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.sent += int64(n)
+	return n, err
+}
+
+// Close on the body closes the original, then runs the logging.
+func (b *statsBody) Close() error {
+	err := b.ReadCloser.Close()
+	if !b.closed {
+		b.closed = true
+		b.stats.Add("bytes_out", b.sent)
+		b.done()
+	}
+	return err
+}
@@ -0,0 +1,52 @@
+/*
+	gobal - tcp_proxy.go
+
+	The tcp_proxy role. Connections are passed blindly to a backend from the
+	service's pool, without looking at what's inside. This is useful for
+	balancing things that don't speak HTTP, such as databases.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// TcpProxyAcceptor takes a connection for a tcp_proxy service and splices it
+// to a backend. Connecting might take a while, so that happens elsewhere.
+func TcpProxyAcceptor(conn net.Conn, svc *Service, ipport string) error {
+	if svc.Pool == nil {
+		return errors.New("no pool configured")
+	}
+	go svc.tcpProxy(conn)
+	return nil
+}
+
+// tcpProxy connects a client to a backend and copies data between them until
+// either side closes.
+func (s *Service) tcpProxy(conn net.Conn) {
+	be, bconn, err := s.Pool.DialBackend(conn)
+	if err != nil {
+		log.Error("tcpProxy(%s): %s", conn.RemoteAddr(), err)
+		s.Stats.Add("tcp.connect_errors", 1)
+		conn.Close()
+		return
+	}
+	log.Debug("tcpProxy: %s connected to %s", conn.RemoteAddr(), be.Ipport)
+
+	s.Stats.Add("tcp.total", 1)
+	s.Stats.Add("tcp.active", 1)
+	in, out, idle := Splice(conn, &bufferedConn{bconn.Conn, bconn.BReader},
+		s.TcpIdle)
+	s.Stats.Add("tcp.active", -1)
+	s.Stats.Add("tcp.bytes_in", in)
+	s.Stats.Add("tcp.bytes_out", out)
+	if idle {
+		s.Stats.Add("tcp.idle_timeouts", 1)
+	}
+	log.Debug("tcpProxy: %s done, %d bytes in, %d bytes out",
+		conn.RemoteAddr(), in, out)
+}
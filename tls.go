@@ -0,0 +1,463 @@
+/*
+	gobal - tls.go
+
+	TLS support for listeners. A service can present many certificates and we
+	select between them based on the SNI name the client asks for. Clients can
+	optionally be asked for a certificate of their own.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certPair is a certificate file and the key file that goes with it. These
+// can be the same file if the PEM contains both.
+type certPair struct {
+	CertFile string
+	KeyFile  string
+}
+
+// CertStore holds the certificates a TLS listener can present. Certificates
+// are indexed by the names they are valid for so that we can pick one based
+// on the SNI name in the client hello.
+type CertStore struct {
+	Pairs   []certPair
+	CertDir string
+
+	// Internal state management variables
+	lock     sync.RWMutex
+	byName   map[string]*tls.Certificate
+	fallback *tls.Certificate
+	mtimes   map[string]time.Time
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// CertStore base implementation
+//////////////////////////////////////////////////////////////////////////////
+
+// NewCertStore builds a store from a list of explicit cert/key pairs and an
+// optional directory to scan. Nothing is loaded until Reload is called.
+func NewCertStore(certs, keys []string, dir string) (*CertStore, error) {
+	if len(certs) != len(keys) {
+		return nil, errors.New(fmt.Sprintf(
+			"have %d ssl_cert_file but %d ssl_key_file", len(certs), len(keys)))
+	}
+	if len(certs) == 0 && dir == "" {
+		return nil, errors.New("enable_ssl requires ssl_cert_file or ssl_cert_dir")
+	}
+
+	cs := &CertStore{CertDir: dir}
+	for i := range certs {
+		cs.Pairs = append(cs.Pairs, certPair{certs[i], keys[i]})
+	}
+	return cs, nil
+}
+
+// dirPairs scans our certificate directory for things that look like
+// certificates. We accept "name.crt" with a matching "name.key", or a
+// "name.pem" that contains both the certificate and the key.
+func (cs *CertStore) dirPairs() ([]certPair, error) {
+	if cs.CertDir == "" {
+		return nil, nil
+	}
+
+	files, err := ioutil.ReadDir(cs.CertDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, fi := range files {
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+
+	var pairs []certPair
+	for _, name := range names {
+		full := path.Join(cs.CertDir, name)
+		switch path.Ext(name) {
+		case ".crt":
+			key := strings.TrimSuffix(full, ".crt") + ".key"
+			if _, err := os.Stat(key); err != nil {
+				log.Warn("certificate %s has no key %s, skipping", full, key)
+				continue
+			}
+			pairs = append(pairs, certPair{full, key})
+		case ".pem":
+			pairs = append(pairs, certPair{full, full})
+		}
+	}
+	return pairs, nil
+}
+
+// allPairs returns the explicit pairs followed by anything in the directory.
+func (cs *CertStore) allPairs() ([]certPair, error) {
+	dpairs, err := cs.dirPairs()
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]certPair{}, cs.Pairs...), dpairs...), nil
+}
+
+// Reload reads every certificate from disk and swaps them in. If anything
+// fails to load, we keep serving the certificates we already have.
+func (cs *CertStore) Reload() error {
+	pairs, err := cs.allPairs()
+	if err != nil {
+		return err
+	}
+	if len(pairs) == 0 {
+		return errors.New("no certificates found")
+	}
+
+	byName := make(map[string]*tls.Certificate)
+	mtimes := make(map[string]time.Time)
+	var fallback *tls.Certificate
+	for _, pair := range pairs {
+		cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+		if err != nil {
+			return errors.New(fmt.Sprintf("%s: %s", pair.CertFile, err))
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return errors.New(fmt.Sprintf("%s: %s", pair.CertFile, err))
+		}
+		cert.Leaf = leaf
+
+		names := leaf.DNSNames
+		if len(names) == 0 && leaf.Subject.CommonName != "" {
+			names = []string{leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			if _, ok := byName[name]; ok {
+				// First one wins, so explicit pairs beat the directory.
+				continue
+			}
+			byName[name] = &cert
+		}
+		if fallback == nil {
+			fallback = &cert
+		}
+
+		for _, file := range []string{pair.CertFile, pair.KeyFile} {
+			if fi, err := os.Stat(file); err == nil {
+				mtimes[file] = fi.ModTime()
+			}
+		}
+	}
+
+	cs.lock.Lock()
+	cs.byName = byName
+	cs.fallback = fallback
+	cs.mtimes = mtimes
+	cs.lock.Unlock()
+
+	log.Info("loaded %d certificates covering %d names", len(pairs), len(byName))
+	return nil
+}
+
+// changed returns true if any of the files we loaded certificates from have
+// been modified, or if the set of files in the directory is different.
+func (cs *CertStore) changed() bool {
+	pairs, err := cs.allPairs()
+	if err != nil {
+		log.Error("failed to scan certificates: %s", err)
+		return false
+	}
+
+	cs.lock.RLock()
+	defer cs.lock.RUnlock()
+
+	uniq := make(map[string]bool)
+	for _, pair := range pairs {
+		for _, file := range []string{pair.CertFile, pair.KeyFile} {
+			fi, err := os.Stat(file)
+			if err != nil {
+				return true
+			}
+			mtime, ok := cs.mtimes[file]
+			if !ok || !fi.ModTime().Equal(mtime) {
+				return true
+			}
+			uniq[file] = true
+		}
+	}
+
+	// Catch files disappearing from the directory.
+	return len(uniq) != len(cs.mtimes)
+}
+
+// reloadWorker runs every 10 seconds and watches our certificate files for
+// changes, reloading them as necessary. This lets short lived certificates
+// be rotated without touching the listeners.
+func (cs *CertStore) reloadWorker() {
+	for {
+		time.Sleep(10 * time.Second)
+
+		if !cs.changed() {
+			continue
+		}
+		log.Debug("certificates changed on disk, reloading")
+		if err := cs.Reload(); err != nil {
+			log.Error("failed to reload certificates: %s", err)
+		}
+	}
+}
+
+// GetCertificate picks a certificate for a client hello. We try an exact
+// match on the SNI name, then a wildcard match, then fall back to the first
+// certificate we loaded.
+func (cs *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cs.lock.RLock()
+	defer cs.lock.RUnlock()
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name != "" {
+		if cert, ok := cs.byName[name]; ok {
+			return cert, nil
+		}
+		if idx := strings.Index(name, "."); idx > -1 {
+			if cert, ok := cs.byName["*"+name[idx:]]; ok {
+				return cert, nil
+			}
+		}
+	}
+
+	if cs.fallback == nil {
+		return nil, errors.New("no certificates loaded")
+	}
+	return cs.fallback, nil
+}
+
+// TlsConfig builds the configuration used by a listener backed by this store.
+func (cs *CertStore) TlsConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: cs.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// ClientVerifier implementation
+//////////////////////////////////////////////////////////////////////////////
+
+// ClientVerifier handles checking certificates presented by clients. The CA
+// bundle is loaded once, but the CRL can be reloaded at runtime. A CRL is only
+// used if it's signed by one of our CAs, and only revokes certificates issued
+// by that CA. Once a CRL is past its next update, nobody is let in until a
+// newer one is loaded, as we can't know who has been revoked since.
+type ClientVerifier struct {
+	Required          bool
+	CAFile            string
+	CRLFile           string
+	SubjectHeader     string
+	FingerprintHeader string
+
+	// Internal state management variables
+	lock    sync.RWMutex
+	cas     *x509.CertPool
+	caCerts []*x509.Certificate
+	revoked map[string]bool
+	expires time.Time
+}
+
+// NewClientVerifier loads the CA bundle and CRL for verifying clients. The
+// mode is "optional" or "required".
+func NewClientVerifier(mode, cafile, crlfile string) (*ClientVerifier, error) {
+	if cafile == "" {
+		return nil, errors.New("ssl_verify_client requires ssl_client_ca_file")
+	}
+
+	data, err := ioutil.ReadFile(cafile)
+	if err != nil {
+		return nil, err
+	}
+	cas := x509.NewCertPool()
+	var caCerts []*x509.Certificate
+	for blk, rest := pem.Decode(data); blk != nil; blk, rest = pem.Decode(rest) {
+		if blk.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(blk.Bytes)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%s: %s", cafile, err))
+		}
+		cas.AddCert(cert)
+		caCerts = append(caCerts, cert)
+	}
+	if len(caCerts) == 0 {
+		return nil, errors.New(fmt.Sprintf("%s: no certificates found", cafile))
+	}
+
+	cv := &ClientVerifier{
+		Required:          mode == "required",
+		CAFile:            cafile,
+		CRLFile:           crlfile,
+		SubjectHeader:     "X-SSL-Client-Subject",
+		FingerprintHeader: "X-SSL-Client-Fingerprint",
+		cas:               cas,
+		caCerts:           caCerts,
+	}
+	if err := cv.Reload(); err != nil {
+		return nil, err
+	}
+	return cv, nil
+}
+
+// Reload rereads the CRL, if we have one. The file can be a single DER CRL,
+// or one or more in PEM for when there are several CAs.
+func (cv *ClientVerifier) Reload() error {
+	if cv.CRLFile == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(cv.CRLFile)
+	if err != nil {
+		return err
+	}
+	var ders [][]byte
+	for blk, rest := pem.Decode(data); blk != nil; blk, rest = pem.Decode(rest) {
+		if blk.Type == "X509 CRL" {
+			ders = append(ders, blk.Bytes)
+		}
+	}
+	if ders == nil {
+		ders = [][]byte{data}
+	}
+
+	revoked := make(map[string]bool)
+	var expires time.Time
+	for _, der := range ders {
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return errors.New(fmt.Sprintf("%s: %s", cv.CRLFile, err))
+		}
+		if err := cv.checkCRL(crl); err != nil {
+			return errors.New(fmt.Sprintf("%s: %s", cv.CRLFile, err))
+		}
+		for _, entry := range crl.RevokedCertificateEntries {
+			revoked[revokedKey(crl.RawIssuer, entry.SerialNumber)] = true
+		}
+		if !crl.NextUpdate.IsZero() &&
+			(expires.IsZero() || crl.NextUpdate.Before(expires)) {
+			expires = crl.NextUpdate
+		}
+	}
+
+	cv.lock.Lock()
+	cv.revoked = revoked
+	cv.expires = expires
+	cv.lock.Unlock()
+
+	log.Info("loaded %d revoked serials from %s", len(revoked), cv.CRLFile)
+	if !expires.IsZero() && time.Now().After(expires) {
+		log.Warn("%s expired at %s, client certificates will be refused",
+			cv.CRLFile, expires)
+	}
+	return nil
+}
+
+// checkCRL makes sure a CRL was signed by one of our CAs. Anyone could have
+// written the file otherwise.
+func (cv *ClientVerifier) checkCRL(crl *x509.RevocationList) error {
+	for _, ca := range cv.caCerts {
+		if !bytes.Equal(ca.RawSubject, crl.RawIssuer) {
+			continue
+		}
+		if err := crl.CheckSignatureFrom(ca); err == nil {
+			return nil
+		}
+	}
+	return errors.New("CRL is not signed by any of our CAs")
+}
+
+// revokedKey is how a revoked certificate is known: serials are only unique
+// for a given issuer.
+func revokedKey(issuer []byte, serial *big.Int) string {
+	return string(issuer) + "/" + serial.String()
+}
+
+// verifyPeer is called by the TLS stack once the chain has been verified
+// against our CAs. All that is left to do is check for revocation.
+func (cv *ClientVerifier) verifyPeer(raw [][]byte, chains [][]*x509.Certificate) error {
+	cv.lock.RLock()
+	defer cv.lock.RUnlock()
+
+	if len(chains) > 0 && !cv.expires.IsZero() && time.Now().After(cv.expires) {
+		return errors.New(fmt.Sprintf("%s expired at %s", cv.CRLFile,
+			cv.expires))
+	}
+
+	for _, chain := range chains {
+		for _, cert := range chain {
+			if cv.revoked[revokedKey(cert.RawIssuer, cert.SerialNumber)] {
+				return errors.New(fmt.Sprintf("certificate %s is revoked",
+					cert.Subject))
+			}
+		}
+	}
+	return nil
+}
+
+// Apply turns on client verification in a listener's configuration.
+func (cv *ClientVerifier) Apply(cfg *tls.Config) {
+	cfg.ClientCAs = cv.cas
+	cfg.VerifyPeerCertificate = cv.verifyPeer
+	if cv.Required {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	} else {
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+}
+
+// SetIdentity forwards the identity of a verified client to the backend. Any
+// values the client sent in these headers are removed first so that they
+// can't be spoofed.
+func (cv *ClientVerifier) SetIdentity(conn net.Conn, req *http.Request) {
+	if cv.SubjectHeader != "" {
+		req.Header.Del(cv.SubjectHeader)
+	}
+	if cv.FingerprintHeader != "" {
+		req.Header.Del(cv.FingerprintHeader)
+	}
+
+	tconn, ok := conn.(*tls.Conn)
+	if !ok {
+		return
+	}
+	state := tconn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return
+	}
+
+	leaf := state.PeerCertificates[0]
+	if cv.SubjectHeader != "" {
+		req.Header.Set(cv.SubjectHeader, leaf.Subject.String())
+	}
+	if cv.FingerprintHeader != "" {
+		sum := sha256.Sum256(leaf.Raw)
+		req.Header.Set(cv.FingerprintHeader, hex.EncodeToString(sum[:]))
+	}
+}
@@ -0,0 +1,381 @@
+/*
+	gobal - tls_test.go
+
+	Tests for picking certificates by SNI name and reloading them, and for
+	verifying client certificates.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate and its key, made up for a test.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// makeCert makes a certificate from a template, signed by parent, or by
+// itself if parent is nil.
+func makeCert(t *testing.T, tmpl *x509.Certificate, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey,
+		signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert, key}
+}
+
+// makeCA makes a CA certificate that can sign certificates and CRLs.
+func makeCA(t *testing.T, name string) *testCert {
+	return makeCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		SubjectKeyId:          []byte(name),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}, nil)
+}
+
+// certPEM is a certificate in PEM.
+func (c *testCert) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE",
+		Bytes: c.cert.Raw})
+}
+
+// keyPEM is a certificate's key in PEM.
+func (c *testCert) keyPEM(t *testing.T) []byte {
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+// writeFile writes a file for a test, failing it if that doesn't work.
+func writeFile(t *testing.T, file string, data ...[]byte) {
+	var all []byte
+	for _, d := range data {
+		all = append(all, d...)
+	}
+	if err := ioutil.WriteFile(file, all, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertStoreGetCertificate(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gobal-tls-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	dir := path.Join(tmp, "certs")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// An explicit pair, and a directory with a .crt and .key pair and a .pem
+	// with both in it. Serials tell them apart.
+	cert := func(serial int64, cn string, names ...string) *testCert {
+		return makeCert(t, &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: cn},
+			DNSNames:     names,
+		}, nil)
+	}
+	www := cert(1, "www", "www.site.com")
+	writeFile(t, tmp+"/www.crt", www.certPEM())
+	writeFile(t, tmp+"/www.key", www.keyPEM(t))
+	wild := cert(2, "wild", "*.site.com")
+	writeFile(t, dir+"/wild.crt", wild.certPEM())
+	writeFile(t, dir+"/wild.key", wild.keyPEM(t))
+	other := cert(3, "other.com")
+	writeFile(t, dir+"/other.pem", other.certPEM(), other.keyPEM(t))
+
+	cs, err := NewCertStore([]string{tmp + "/www.crt"},
+		[]string{tmp + "/www.key"}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cs.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		serial int64
+	}{
+		{"www.site.com", 1},
+		{"WWW.Site.Com.", 1},
+		{"img.site.com", 2},
+		{"other.com", 3},
+
+		// Wildcards cover one level, anything else gets the first we loaded.
+		{"a.b.site.com", 1},
+		{"site.com", 1},
+		{"nowhere.com", 1},
+		{"", 1},
+	}
+	check := func() {
+		for _, test := range tests {
+			got, err := cs.GetCertificate(&tls.ClientHelloInfo{
+				ServerName: test.name})
+			if err != nil {
+				t.Errorf("%q: %s", test.name, err)
+			} else if got.Leaf.SerialNumber.Int64() != test.serial {
+				t.Errorf("%q got serial %s; want %d", test.name,
+					got.Leaf.SerialNumber, test.serial)
+			}
+		}
+	}
+	check()
+	if cs.changed() {
+		t.Errorf("nothing changed, but changed() is true")
+	}
+
+	// Replace the wildcard pair, the way a daily rotation would.
+	wild = cert(4, "wild", "*.site.com", "new.com")
+	writeFile(t, dir+"/wild.crt", wild.certPEM())
+	writeFile(t, dir+"/wild.key", wild.keyPEM(t))
+	later := time.Now().Add(time.Minute)
+	for _, file := range []string{dir + "/wild.crt", dir + "/wild.key"} {
+		if err := os.Chtimes(file, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !cs.changed() {
+		t.Fatalf("changed() missed the new pair")
+	}
+	if err := cs.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	tests[2].serial = 4
+	tests = append(tests, struct {
+		name   string
+		serial int64
+	}{"new.com", 4})
+	check()
+
+	// A broken pair is refused, and what we had is kept.
+	writeFile(t, dir+"/wild.key", []byte("nonsense"))
+	if err := cs.Reload(); err == nil {
+		t.Errorf("Reload took a broken key")
+	}
+	check()
+}
+
+// makeCRL makes a CRL in PEM, claiming to be from ca but signed by signer.
+func makeCRL(t *testing.T, ca, signer *testCert, next time.Time,
+	serials ...int64) []byte {
+	tmpl := &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-2 * time.Hour),
+		NextUpdate: next,
+	}
+	for _, serial := range serials {
+		tmpl.RevokedCertificateEntries = append(tmpl.RevokedCertificateEntries,
+			x509.RevocationListEntry{
+				SerialNumber:   big.NewInt(serial),
+				RevocationTime: time.Now().Add(-time.Hour),
+			})
+	}
+	issuer := *ca.cert
+	issuer.PublicKey = &signer.key.PublicKey
+	der, err := x509.CreateRevocationList(rand.Reader, tmpl, &issuer,
+		signer.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+}
+
+func TestClientVerifierRevocation(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gobal-tls-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// Two CAs, each with a client certificate with the same serial.
+	caA, caB := makeCA(t, "CA A"), makeCA(t, "CA B")
+	client := func(ca *testCert, cn string) *testCert {
+		return makeCert(t, &x509.Certificate{
+			SerialNumber: big.NewInt(10),
+			Subject:      pkix.Name{CommonName: cn},
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, ca)
+	}
+	fromA, fromB := client(caA, "a"), client(caB, "b")
+	writeFile(t, tmp+"/ca.pem", caA.certPEM(), caB.certPEM())
+
+	tests := []struct {
+		name    string
+		crl     []byte
+		loads   bool
+		revoked map[*testCert]bool
+	}{
+		{"A revokes 10", makeCRL(t, caA, caA, time.Now().Add(time.Hour), 10),
+			true, map[*testCert]bool{fromA: true, fromB: false}},
+		{"B revokes 11", makeCRL(t, caB, caB, time.Now().Add(time.Hour), 11),
+			true, map[*testCert]bool{fromA: false, fromB: false}},
+
+		// Past its next update, nobody with a certificate gets in.
+		{"expired", makeCRL(t, caA, caA, time.Now().Add(-time.Hour)),
+			true, map[*testCert]bool{fromA: true, fromB: true}},
+
+		// Anyone can write a CRL with our CA's name on it.
+		{"forged", makeCRL(t, caA, caB, time.Now().Add(time.Hour), 11),
+			false, nil},
+	}
+
+	for _, test := range tests {
+		writeFile(t, tmp+"/crl.pem", test.crl)
+		cv, err := NewClientVerifier("required", tmp+"/ca.pem",
+			tmp+"/crl.pem")
+		if (err == nil) != test.loads {
+			t.Errorf("%s: loading gave %v", test.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		for cert, revoked := range test.revoked {
+			ca := caA
+			if cert == fromB {
+				ca = caB
+			}
+			err := cv.verifyPeer(nil, [][]*x509.Certificate{{cert.cert, ca.cert}})
+			if (err != nil) != revoked {
+				t.Errorf("%s: %s gave %v", test.name, cert.cert.Subject, err)
+			}
+		}
+
+		// Without a certificate, there's nothing to check.
+		if err := cv.verifyPeer(nil, nil); err != nil {
+			t.Errorf("%s: no certificate gave %s", test.name, err)
+		}
+	}
+}
+
+func TestClientVerifierSetIdentity(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gobal-tls-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	ca := makeCA(t, "CA")
+	writeFile(t, tmp+"/ca.pem", ca.certPEM())
+	server := makeCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		DNSNames:     []string{"gobal.test"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+	client := makeCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "alice"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+
+	cv, err := NewClientVerifier("optional", tmp+"/ca.pem", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Shake hands over a pipe, with or without a client certificate.
+	connect := func(cert *testCert) net.Conn {
+		cfg := &tls.Config{Certificates: []tls.Certificate{{
+			Certificate: [][]byte{server.cert.Raw},
+			PrivateKey:  server.key,
+		}}}
+		cv.Apply(cfg)
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.cert)
+		ccfg := &tls.Config{RootCAs: roots, ServerName: "gobal.test"}
+		if cert != nil {
+			ccfg.Certificates = []tls.Certificate{{
+				Certificate: [][]byte{cert.cert.Raw},
+				PrivateKey:  cert.key,
+			}}
+		}
+
+		c, s := net.Pipe()
+		sconn := tls.Server(s, cfg)
+		done := make(chan error)
+		go func() { done <- tls.Client(c, ccfg).Handshake() }()
+		if err := sconn.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		return sconn
+	}
+
+	sum := sha256.Sum256(client.cert.Raw)
+	tests := []struct {
+		name        string
+		conn        net.Conn
+		subject     string
+		fingerprint string
+	}{
+		{"plain", &net.TCPConn{}, "", ""},
+		{"no certificate", connect(nil), "", ""},
+		{"certificate", connect(client), "CN=alice", hex.EncodeToString(sum[:])},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("X-SSL-Client-Subject", "CN=admin")
+		req.Header.Add("X-SSL-Client-Subject", "CN=root")
+		req.Header.Set("X-SSL-Client-Fingerprint", "00")
+		cv.SetIdentity(test.conn, req)
+
+		subject := req.Header["X-Ssl-Client-Subject"]
+		fingerprint := req.Header["X-Ssl-Client-Fingerprint"]
+		if test.subject == "" && (subject != nil || fingerprint != nil) {
+			t.Errorf("%s: left %v, %v", test.name, subject, fingerprint)
+		} else if test.subject != "" && (len(subject) != 1 ||
+			subject[0] != test.subject || len(fingerprint) != 1 ||
+			fingerprint[0] != test.fingerprint) {
+			t.Errorf("%s: got %v, %v", test.name, subject, fingerprint)
+		}
+	}
+}
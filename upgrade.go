@@ -0,0 +1,137 @@
+/*
+	gobal - upgrade.go
+
+	Passing through requests that switch protocols, such as WebSockets. Once
+	the backend agrees to the switch, we stop speaking HTTP and just copy
+	bytes between the client and the backend until one of them goes away.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// upgradedBackend is handed to the client in place of a response body when
+// a backend switches protocols. It reads and writes the raw connection.
+type upgradedBackend struct {
+	*bufferedConn
+	hconn *HttpBackendConnection
+}
+
+// IsUpgradeRequest returns true if a client is asking to switch protocols.
+func IsUpgradeRequest(req *http.Request) bool {
+	return req.Header.Get("Upgrade") != "" &&
+		HasToken(req.Header, "Connection", "upgrade")
+}
+
+// upgradeFor returns the protocol a request wants to switch to, if it's one
+// we'd pass on. Only HTTP/1.1 clients can be upgraded, as that's the only
+// place we can take over the connection afterwards.
+func upgradeFor(req ServiceRequest) string {
+	if _, isHttp := req.client.(*HttpConnection); !isHttp {
+		return ""
+	}
+	if !IsUpgradeRequest(req.request) {
+		return ""
+	}
+	return req.request.Header.Get("Upgrade")
+}
+
+// closeWriter is a connection that can be half closed, such as a
+// *net.TCPConn or a *tls.Conn.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// SPLICE_HALF_CLOSED_IDLE is the longest a spliced connection can go quiet
+// once one side has finished sending, even without an idle timeout. Without
+// it, a peer that never closes its side would keep us around forever.
+const SPLICE_HALF_CLOSED_IDLE = 5 * time.Minute
+
+// Splice copies data both ways between two connections until both sides are
+// done, or until nothing has moved for the idle timeout. When one side
+// finishes sending, we half close the other so it sees the end of the data
+// but can still answer; from then on, SPLICE_HALF_CLOSED_IDLE applies too.
+// Both connections are closed when we're done. Returns the number of bytes
+// copied from a to b and from b to a, and whether we gave up because it was
+// idle.
+func Splice(a, b io.ReadWriteCloser, idle time.Duration) (int64, int64, bool) {
+	var atob, btoa int64
+	last := time.Now().UnixNano()
+	done := make(chan bool, 2)
+
+	// Each pipe reports whether it finished cleanly and passed the end of the
+	// data on, in which case the other direction can carry on by itself.
+	pipe := func(dst io.Writer, src io.Reader, count *int64) {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := src.Read(buf)
+			if n > 0 {
+				atomic.StoreInt64(&last, time.Now().UnixNano())
+				if _, werr := dst.Write(buf[:n]); werr != nil {
+					done <- false
+					return
+				}
+				atomic.AddInt64(count, int64(n))
+			}
+			if err == io.EOF {
+				cw, ok := dst.(closeWriter)
+				done <- ok && cw.CloseWrite() == nil
+				return
+			} else if err != nil {
+				done <- false
+				return
+			}
+		}
+	}
+	go pipe(b, a, &atob)
+	go pipe(a, b, &btoa)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	// Wait for both directions to finish, or for one to fail, or for things
+	// to go quiet. Then close both sides, which stops anything still copying.
+	waiting, timedOut := 2, false
+WAIT:
+	for waiting > 0 {
+		select {
+		case clean := <-done:
+			waiting--
+			if !clean {
+				break WAIT
+			}
+			if idle == 0 || idle > SPLICE_HALF_CLOSED_IDLE {
+				idle = SPLICE_HALF_CLOSED_IDLE
+			}
+		case <-ticker.C:
+			since := time.Now().UnixNano() - atomic.LoadInt64(&last)
+			if idle > 0 && time.Duration(since) > idle {
+				timedOut = true
+				break WAIT
+			}
+		}
+	}
+	a.Close()
+	b.Close()
+	for ; waiting > 0; waiting-- {
+		<-done
+	}
+	return atomic.LoadInt64(&atob), atomic.LoadInt64(&btoa), timedOut
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// upgradedBackend implementation
+//////////////////////////////////////////////////////////////////////////////
+
+// Close drops the connection to the backend. It can't be reused, as it's no
+// longer speaking HTTP.
+func (u *upgradedBackend) Close() error {
+	return u.hconn.Close()
+}
@@ -0,0 +1,59 @@
+/*
+	gobal - upgrade_test.go
+
+	Tests for spotting requests that switch protocols.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestUpgradeFor(t *testing.T) {
+	tests := []struct {
+		upgrade    string
+		connection []string
+		want       string
+	}{
+		{"websocket", []string{"Upgrade"}, "websocket"},
+		{"websocket", []string{"keep-alive, UPGRADE"}, "websocket"},
+		{"websocket", []string{"keep-alive", "upgrade"}, "websocket"},
+		{"h2c", []string{"Upgrade, HTTP2-Settings"}, "h2c"},
+
+		// It takes both headers, and Connection has to name upgrade itself.
+		{"websocket", nil, ""},
+		{"websocket", []string{"keep-alive"}, ""},
+		{"websocket", []string{"upgrades"}, ""},
+		{"", []string{"upgrade"}, ""},
+	}
+
+	client, _ := net.Pipe()
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/", nil)
+		if test.upgrade != "" {
+			req.Header.Set("Upgrade", test.upgrade)
+		}
+		req.Header["Connection"] = test.connection
+		if got := IsUpgradeRequest(req); got != (test.want != "") {
+			t.Errorf("%s, %q: IsUpgradeRequest = %v", test.upgrade,
+				test.connection, got)
+		}
+
+		// Only HTTP/1.1 connections can be handed over.
+		if got := upgradeFor(ServiceRequest{client: &HttpConnection{},
+			request: req}); got != test.want {
+			t.Errorf("%s, %q: upgradeFor = %q", test.upgrade,
+				test.connection, got)
+		}
+		if got := upgradeFor(ServiceRequest{client: client,
+			request: req}); got != "" {
+			t.Errorf("%s, %q: upgraded a connection that isn't HTTP/1.1",
+				test.upgrade, test.connection)
+		}
+	}
+}
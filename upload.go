@@ -0,0 +1,279 @@
+/*
+	gobal - upload.go
+
+	Buffering request bodies before they go to a backend. A slow client
+	uploading something big would otherwise hold on to a backend connection
+	for as long as it takes. Small bodies are kept in memory, anything bigger
+	goes to a temporary file.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errUploadTooLarge is returned when a body is bigger than max_upload_size.
+var errUploadTooLarge = errors.New("upload too large")
+
+// UploadProgress describes a body that we're in the middle of receiving. These
+// are listed on the management port with SHOW UPLOADS.
+type UploadProgress struct {
+	Service  string
+	Client   string
+	URI      string
+	Total    int64
+	Started  time.Time
+	received int64
+}
+
+// limitedBody is a body going straight to a backend, which fails once it
+// goes over max_upload_size.
+type limitedBody struct {
+	io.ReadCloser
+	left     int64
+	tooLarge bool
+}
+
+var uploadsLock sync.Mutex
+var uploads map[*UploadProgress]bool = make(map[*UploadProgress]bool)
+
+// progressReader counts what passes through it.
+type progressReader struct {
+	io.Reader
+	progress *UploadProgress
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// Buffering uploads
+//////////////////////////////////////////////////////////////////////////////
+
+// UploadTooLargeResponse is the 413 for a body bigger than we'll take. We
+// don't read the rest of the body, so the connection is closed afterwards
+// rather than reading it as the next request.
+func UploadTooLargeResponse(req *http.Request) *http.Response {
+	resp := HttpSimpleResponse(req, 413, "Upload too large")
+	resp.Close = true
+	return resp
+}
+
+// HasBody returns true if a request has a body for us to send on.
+func HasBody(req *http.Request) bool {
+	return req.Body != nil && req.Body != http.NoBody && req.ContentLength != 0
+}
+
+// limitUpload holds a body that isn't being buffered to max_upload_size.
+// Returns false, having answered the request, if we already know it's too
+// big; anything else finds out while it's being sent to the backend.
+func (s *Service) limitUpload(req ServiceRequest) bool {
+	if s.MaxUpload == 0 || !HasBody(req.request) {
+		return true
+	}
+	if req.request.ContentLength > s.MaxUpload {
+		s.Stats.Add("uploads.too_large", 1)
+		s.respond(req, UploadTooLargeResponse(req.request))
+		return false
+	}
+	req.request.Body = &limitedBody{ReadCloser: req.request.Body,
+		left: s.MaxUpload}
+	return true
+}
+
+// UploadTooLarge returns true if sending a request failed because its body
+// went over max_upload_size.
+func UploadTooLarge(req *http.Request) bool {
+	body, ok := req.Body.(*limitedBody)
+	return ok && body.tooLarge
+}
+
+// bufferRequest is a goroutine that reads in the whole body of a request
+// before getting a backend for it, then proxies it as usual.
+func (s *Service) bufferRequest(req ServiceRequest) {
+	if s.MaxUpload > 0 && req.request.ContentLength > s.MaxUpload {
+		s.Stats.Add("uploads.too_large", 1)
+		s.respond(req, UploadTooLargeResponse(req.request))
+		return
+	}
+
+	// Closing the body reads whatever is left of it, which we don't want to
+	// do for one that's too big.
+	body, size, err := s.spoolBody(req)
+	if err == errUploadTooLarge {
+		s.Stats.Add("uploads.too_large", 1)
+		s.respond(req, UploadTooLargeResponse(req.request))
+		return
+	}
+	req.request.Body.Close()
+	if err != nil {
+		log.Error("bufferRequest(%s): %s", req.request.RequestURI, err)
+		s.respond(req, HttpErrorResponse(req.request, err))
+		return
+	}
+
+	// The backend gets the body all at once, with its length up front.
+	s.Stats.Add("uploads.buffered", 1)
+	req.request.Body = body
+	req.request.ContentLength = size
+	req.request.TransferEncoding = nil
+	req.request.Header.Del("Transfer-Encoding")
+
+	be := s.Pool.GetBackendFor(req.client)
+	if be == nil {
+		body.Close()
+		s.respond(req, ProxyErrorResponse(req.request,
+			errors.New("no backends available")))
+		return
+	}
+	s.proxyRequest(req, be)
+}
+
+// spoolBody reads the body of a request into memory, switching to a temporary
+// file if it gets too big. Returns the body, ready to be read again, and its
+// size. Progress is tracked while we're reading.
+func (s *Service) spoolBody(req ServiceRequest) (io.ReadCloser, int64, error) {
+	progress := s.trackUpload(req)
+	defer progress.Done()
+
+	// Read one byte more than we're allowed, so we know if it's too big.
+	var rdr io.Reader = &progressReader{req.request.Body, progress}
+	if s.MaxUpload > 0 {
+		rdr = io.LimitReader(rdr, s.MaxUpload+1)
+	}
+
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, rdr, s.UploadMemory+1)
+	if err == io.EOF {
+		if s.MaxUpload > 0 && n > s.MaxUpload {
+			return nil, 0, errUploadTooLarge
+		}
+		return ioutil.NopCloser(bytes.NewReader(buf.Bytes())), n, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	// Too big for memory, so on to disk. The file is unlinked right away so
+	// that it's cleaned up however we finish with it; closing it is enough.
+	f, err := ioutil.TempFile(s.UploadPath, "gobal-upload-")
+	if err != nil {
+		return nil, 0, err
+	}
+	os.Remove(f.Name())
+	s.Stats.Add("uploads.spooled", 1)
+
+	size, err := io.Copy(f, io.MultiReader(&buf, rdr))
+	if err == nil && s.MaxUpload > 0 && size > s.MaxUpload {
+		err = errUploadTooLarge
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, size, nil
+}
+
+// trackUpload lists a request's body as being uploaded until Done is called.
+func (s *Service) trackUpload(req ServiceRequest) *UploadProgress {
+	progress := &UploadProgress{
+		Service: s.Name,
+		Client:  req.client.RemoteAddr().String(),
+		URI:     req.request.RequestURI,
+		Total:   req.request.ContentLength,
+		Started: time.Now(),
+	}
+	uploadsLock.Lock()
+	uploads[progress] = true
+	uploadsLock.Unlock()
+	return progress
+}
+
+// Uploads returns the uploads that are in progress, oldest first.
+func Uploads() []*UploadProgress {
+	uploadsLock.Lock()
+	defer uploadsLock.Unlock()
+
+	list := make([]*UploadProgress, 0, len(uploads))
+	for progress := range uploads {
+		list = append(list, progress)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Started.Before(list[j].Started)
+	})
+	return list
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// UploadProgress implementation
+//////////////////////////////////////////////////////////////////////////////
+
+// Received is how many bytes of the body we have so far.
+func (p *UploadProgress) Received() int64 {
+	return atomic.LoadInt64(&p.received)
+}
+
+// Done says we've finished receiving an upload.
+func (p *UploadProgress) Done() {
+	uploadsLock.Lock()
+	delete(uploads, p)
+	uploadsLock.Unlock()
+}
+
+// String describes the upload for the management port.
+func (p *UploadProgress) String() string {
+	total := "?"
+	if p.Total >= 0 {
+		total = fmt.Sprintf("%d", p.Total)
+	}
+	return fmt.Sprintf("%s %s %s %d/%s %ds", p.Service, p.Client, p.URI,
+		p.Received(), total, int(time.Since(p.Started).Seconds()))
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	atomic.AddInt64(&r.progress.received, int64(n))
+	return n, err
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// limitedBody implementation
+//////////////////////////////////////////////////////////////////////////////
+
+// Read reads at most one byte more than we're allowed, so we know if there
+// is more, but never hands that byte on.
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.tooLarge {
+		return 0, errUploadTooLarge
+	}
+	if int64(len(p)) > b.left+1 {
+		p = p[:b.left+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if b.left -= int64(n); b.left < 0 {
+		b.tooLarge = true
+		return n - 1, errUploadTooLarge
+	}
+	return n, err
+}
+
+// Close closes the body, unless it was too big. Closing reads whatever is
+// left, which we don't want to do for one of those.
+func (b *limitedBody) Close() error {
+	if b.tooLarge {
+		return nil
+	}
+	return b.ReadCloser.Close()
+}
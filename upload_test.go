@@ -0,0 +1,142 @@
+/*
+	gobal - upload_test.go
+
+	Tests for buffering request bodies and holding them to max_upload_size.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLimitedBody(t *testing.T) {
+	tests := []struct {
+		size     int
+		tooLarge bool
+	}{
+		{0, false},
+		{99, false},
+		{100, false},
+		{101, true},
+		{100000, true},
+	}
+
+	for _, test := range tests {
+		body := &limitedBody{
+			ReadCloser: ioutil.NopCloser(strings.NewReader(
+				strings.Repeat("a", test.size))),
+			left: 100,
+		}
+		data, err := ioutil.ReadAll(body)
+		if test.tooLarge {
+			if err != errUploadTooLarge || len(data) > 100 {
+				t.Errorf("%d bytes: read %d, %v", test.size, len(data), err)
+			}
+		} else if err != nil || len(data) != test.size {
+			t.Errorf("%d bytes: read %d, %v", test.size, len(data), err)
+		}
+
+		req, _ := http.NewRequest("POST", "/", nil)
+		req.Body = body
+		if UploadTooLarge(req) != test.tooLarge {
+			t.Errorf("%d bytes: UploadTooLarge = %v", test.size, !test.tooLarge)
+		}
+	}
+}
+
+// uploadRequest is a request with a body of some size, whose length is only
+// known up front if sized is set.
+func uploadRequest(size int, sized bool) ServiceRequest {
+	req, _ := http.NewRequest("POST", "/upload", strings.NewReader(
+		strings.Repeat("a", size)))
+	if !sized {
+		req.ContentLength = -1
+	}
+	client, _ := net.Pipe()
+	return ServiceRequest{client: client, request: req,
+		rchan: make(chan *http.Response, 1)}
+}
+
+func TestSpoolBody(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gobal-upload-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	s := &Service{Name: "test", Stats: NewServiceStats(), UploadPath: tmp,
+		UploadMemory: 10, MaxUpload: 100}
+
+	tests := []struct {
+		size     int
+		spooled  bool
+		tooLarge bool
+	}{
+		{0, false, false},
+		{10, false, false},
+		{11, true, false},
+		{100, true, false},
+		{101, true, true},
+		{1000, true, true},
+	}
+
+	for _, test := range tests {
+		spooled := s.Stats.Get("uploads.spooled")
+		body, size, err := s.spoolBody(uploadRequest(test.size, false))
+		if test.tooLarge {
+			if err != errUploadTooLarge {
+				t.Errorf("%d bytes: got %v; want too large", test.size, err)
+			}
+		} else if err != nil {
+			t.Errorf("%d bytes: %s", test.size, err)
+		} else {
+			data, _ := ioutil.ReadAll(body)
+			_, isFile := body.(*os.File)
+			if len(data) != test.size || size != int64(test.size) ||
+				isFile != test.spooled {
+				t.Errorf("%d bytes: read %d of %d, in a file %v", test.size,
+					len(data), size, isFile)
+			}
+			body.Close()
+		}
+		if (s.Stats.Get("uploads.spooled") > spooled) != test.spooled {
+			t.Errorf("%d bytes: spooled %v; want %v", test.size, !test.spooled,
+				test.spooled)
+		}
+
+		// Temporary files go as soon as they're made, and the upload is
+		// no longer listed once we have it.
+		if files, _ := ioutil.ReadDir(tmp); len(files) != 0 {
+			t.Errorf("%d bytes: left %d files", test.size, len(files))
+		}
+		if list := Uploads(); len(list) != 0 {
+			t.Errorf("%d bytes: still listed as %s", test.size, list[0])
+		}
+	}
+}
+
+func TestBufferRequestTooLarge(t *testing.T) {
+	s := &Service{Name: "test", Stats: NewServiceStats(),
+		UploadPath: os.TempDir(), UploadMemory: 10, MaxUpload: 100}
+
+	// Whether or not we know up front, a body that's too big gets a 413
+	// before we ever look for a backend.
+	for _, sized := range []bool{true, false} {
+		req := uploadRequest(101, sized)
+		s.bufferRequest(req)
+		if resp := <-req.rchan; resp.StatusCode != 413 || !resp.Close {
+			t.Errorf("sized %v: got %d, close %v", sized, resp.StatusCode,
+				resp.Close)
+		}
+	}
+	if got := s.Stats.Get("uploads.too_large"); got != 2 {
+		t.Errorf("counted %d too large", got)
+	}
+}
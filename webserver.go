@@ -0,0 +1,289 @@
+/*
+	gobal - webserver.go
+
+	The web_server role, which serves files out of a document root. For
+	directories we send the first index file that exists, or if there isn't
+	one and dirindexing is on, a listing of what's in there. Files are sent
+	with a Content-Type picked by their extension.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// dirEntry is one line of a directory listing, as sent in JSON.
+type dirEntry struct {
+	Name     string    `json:"name"`
+	Dir      bool      `json:"dir"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// Serving files
+//////////////////////////////////////////////////////////////////////////////
+
+// serveFile takes as input a request from a client and then does something
+// useful with that request. This is only called on ROLE_WEBSERVER services.
+func (s *Service) serveFile(req ServiceRequest) {
+	method := req.request.Method
+	if (method == "PUT" && s.EnablePut) ||
+		(method == "DELETE" && s.EnableDelete) {
+		s.changeFile(req)
+		return
+	}
+	if method != "GET" && method != "HEAD" {
+		resp := HttpSimpleResponse(req.request, 405, "Method not allowed")
+		resp.Header.Set("Allow", s.allowedMethods())
+		s.respond(req, resp)
+		return
+	}
+
+	filepath, err := CleanPath(s.DocRoot, req.request.URL.Path)
+	if err != nil {
+		s.respond(req, HttpSimpleResponse(req.request, 403, "Forbidden"))
+		return
+	}
+
+	cf, err := s.files.Open(filepath)
+	if err != nil {
+		s.respond(req, FileErrorResponse(req.request, err))
+		return
+	}
+
+	if cf.Info.IsDir() {
+		s.files.Release(cf)
+		s.serveDirectory(req, filepath)
+		return
+	}
+	s.sendFile(req, filepath, cf)
+}
+
+// sendFile sends a file to the client, or the parts of it that were asked
+// for. Clients that already have it are told so instead. The file is given
+// back to the cache once it's been sent.
+func (s *Service) sendFile(req ServiceRequest, filepath string, cf *CachedFile) {
+	// The type comes from the file that was asked for, even if what we send
+	// is its .gz.
+	ctype := s.contentType(filepath)
+	resp := &http.Response{
+		Request:    req.request,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+	}
+	if s.GzipStatic || s.Gzip {
+		resp.Header.Set("Vary", "Accept-Encoding")
+	}
+	if gz := s.precompressed(req.request, filepath); gz != nil {
+		s.files.Release(cf)
+		cf = gz
+		resp.Header.Set("Content-Encoding", "gzip")
+		s.Stats.Add("gzip.static", 1)
+	}
+
+	fi := cf.Info
+	size, modtime, etag := fi.Size(), fi.ModTime(), FileEtag(fi)
+	compress := resp.Header.Get("Content-Encoding") == "" &&
+		s.shouldGzip(req.request, ctype, size)
+	if compress {
+		etag = gzipEtag(etag)
+	}
+	resp.Header.Set("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+	resp.Header.Set("Etag", etag)
+
+	if status := checkConditions(req.request, modtime, etag); status != 0 {
+		s.files.Release(cf)
+		resp.StatusCode = status
+		resp.Status = StatusForCode(status)
+		s.respond(req, resp)
+		return
+	}
+	if compress {
+		s.sendGzipped(req, resp, filepath, etag, ctype, cf)
+		return
+	}
+	resp.Header.Set("Accept-Ranges", "bytes")
+
+	var err error
+	var ranges []byteRange
+	if ifRangeMatches(req.request, modtime, etag) {
+		ranges, err = parseRange(req.request.Header.Get("Range"), size)
+	}
+	if err == errRangeUnsatisfiable {
+		s.files.Release(cf)
+		resp.StatusCode = http.StatusRequestedRangeNotSatisfiable
+		resp.Status = StatusForCode(resp.StatusCode)
+		resp.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		resp.Header.Set("Content-Length", "0")
+		s.respond(req, resp)
+		return
+	}
+
+	// The file may be shared with other requests, so we never read it from
+	// its offset. Single parts of it can go out with sendfile.
+	body := &fileBody{file: cf, cache: s.files, offset: 0, length: size}
+	resp.StatusCode = http.StatusOK
+	switch {
+	case len(ranges) == 1:
+		resp.StatusCode = http.StatusPartialContent
+		body.offset, body.length = ranges[0].start, ranges[0].length
+		resp.Header.Set("Content-Range", ranges[0].contentRange(size))
+	case len(ranges) > 1:
+		resp.StatusCode = http.StatusPartialContent
+		body.Reader, body.length, ctype = multipartRanges(cf.File, ranges,
+			size, ctype)
+	}
+	if body.Reader == nil {
+		body.Reader = io.NewSectionReader(cf.File, body.offset, body.length)
+		resp.ContentLength = body.length
+	} else {
+		// Multipart bodies are made up of several parts of the file, so they
+		// have to be copied.
+		resp.ContentLength, body.length = body.length, -1
+	}
+	resp.Status = StatusForCode(resp.StatusCode)
+	resp.Header.Set("Content-Type", ctype)
+	resp.Header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+
+	// HEAD gets all the same headers, but no body.
+	if req.request.Method == "HEAD" {
+		s.files.Release(cf)
+		s.respond(req, resp)
+		return
+	}
+	resp.Body = body
+	s.respond(req, resp)
+}
+
+// FileErrorResponse turns an error from the filesystem into a response with
+// the right status.
+func FileErrorResponse(req *http.Request, err error) *http.Response {
+	switch {
+	case os.IsNotExist(err), errors.Is(err, syscall.ENOTDIR):
+		return HttpSimpleResponse(req, 404, "Not found")
+	case os.IsPermission(err):
+		return HttpSimpleResponse(req, 403, "Forbidden")
+	}
+	return HttpErrorResponse(req, err)
+}
+
+// serveDirectory handles a request for a directory. Clients that leave off
+// the trailing slash are sent to the right place first, so that relative
+// links work.
+func (s *Service) serveDirectory(req ServiceRequest, dir string) {
+	upath := req.request.URL.Path
+	if !strings.HasSuffix(upath, "/") {
+		loc := &url.URL{Path: upath + "/", RawQuery: req.request.URL.RawQuery}
+		resp := HttpSimpleResponse(req.request, 301, "")
+		resp.Header.Set("Location", loc.String())
+		s.respond(req, resp)
+		return
+	}
+
+	for _, name := range s.IndexFiles {
+		index := path.Join(dir, name)
+		if cf, err := s.files.Open(index); err == nil {
+			if !cf.Info.IsDir() {
+				s.sendFile(req, index, cf)
+				return
+			}
+			s.files.Release(cf)
+		}
+	}
+
+	if !s.DirIndexing {
+		s.respond(req, HttpSimpleResponse(req.request, 403,
+			"Directory listing is not allowed"))
+		return
+	}
+	s.respond(req, s.directoryIndex(req, dir))
+}
+
+// directoryIndex lists a directory, in HTML unless the client asked for JSON
+// with "?format=json" or an Accept header. Hidden files aren't listed.
+func (s *Service) directoryIndex(req ServiceRequest, dir string) *http.Response {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return FileErrorResponse(req.request, err)
+	}
+
+	entries := make([]dirEntry, 0, len(infos))
+	for _, fi := range infos {
+		if strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		entries = append(entries, dirEntry{
+			Name:     fi.Name(),
+			Dir:      fi.IsDir(),
+			Size:     fi.Size(),
+			Modified: fi.ModTime().UTC(),
+		})
+	}
+
+	var body []byte
+	ctype := "text/html; charset=utf-8"
+	if req.request.URL.Query().Get("format") == "json" ||
+		strings.Contains(req.request.Header.Get("Accept"), "application/json") {
+		if body, err = json.MarshalIndent(entries, "", "  "); err != nil {
+			return HttpErrorResponse(req.request,
+				errors.New(fmt.Sprintf("directory index: %s", err)))
+		}
+		body = append(body, '\n')
+		ctype = "application/json"
+	} else {
+		body = indexHtml(req.request.URL.Path, entries)
+	}
+
+	resp := HttpSimpleResponse(req.request, 200, string(body))
+	resp.Header.Set("Content-Type", ctype)
+	return resp
+}
+
+// indexHtml builds the HTML version of a directory listing.
+func indexHtml(upath string, entries []dirEntry) []byte {
+	var buf bytes.Buffer
+	title := html.EscapeString("Index of " + upath)
+	fmt.Fprintf(&buf, "<!DOCTYPE html>\n<html>\n<head><title>%s</title></head>\n"+
+		"<body>\n<h1>%s</h1>\n<table>\n"+
+		"<tr><th>Name</th><th>Last modified</th><th>Size</th></tr>\n",
+		title, title)
+	if upath != "/" {
+		buf.WriteString("<tr><td><a href=\"../\">../</a></td>" +
+			"<td></td><td></td></tr>\n")
+	}
+
+	for _, entry := range entries {
+		name, size := entry.Name, fmt.Sprintf("%d", entry.Size)
+		if entry.Dir {
+			name, size = name+"/", "-"
+		}
+		// This escapes the name, and won't let it look like a scheme.
+		href := (&url.URL{Path: name}).String()
+		fmt.Fprintf(&buf, "<tr><td><a href=\"%s\">%s</a></td><td>%s</td>"+
+			"<td>%s</td></tr>\n", html.EscapeString(href),
+			html.EscapeString(name), entry.Modified.Format("2006-01-02 15:04"),
+			size)
+	}
+
+	buf.WriteString("</table>\n</body>\n</html>\n")
+	return buf.Bytes()
+}
@@ -0,0 +1,108 @@
+/*
+	gobal - webserver_test.go
+
+	Tests for the web server role.
+
+	Copyright (c) 2013 by authors and contributors.
+*/
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIndexHtml(t *testing.T) {
+	when := time.Date(2013, 5, 1, 12, 30, 0, 0, time.UTC)
+	entries := []dirEntry{
+		{Name: "sub", Dir: true, Modified: when},
+		{Name: "<script>.txt", Size: 10, Modified: when},
+		{Name: "a b&c.html", Size: 20, Modified: when},
+		{Name: "javascript:alert(1)", Size: 30, Modified: when},
+		{Name: `"quoted"`, Size: 40, Modified: when},
+	}
+	out := string(indexHtml("/<b>/", entries))
+
+	tests := []string{
+		"<title>Index of /&lt;b&gt;/</title>",
+		`<a href="../">../</a>`,
+		`<a href="sub/">sub/</a></td><td>2013-05-01 12:30</td><td>-</td>`,
+		`<a href="%3Cscript%3E.txt">&lt;script&gt;.txt</a>`,
+		`<a href="a%20b&amp;c.html">a b&amp;c.html</a>`,
+		`<a href="./javascript:alert%281%29">`,
+		`<a href="%22quoted%22">&#34;quoted&#34;</a>`,
+	}
+	for _, want := range tests {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %s in:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "<script>") || strings.Contains(out, "<b>") {
+		t.Errorf("unescaped name in:\n%s", out)
+	}
+
+	// There's nowhere to go up to from the top.
+	if out := string(indexHtml("/", nil)); strings.Contains(out, "../") {
+		t.Errorf("parent link at the top:\n%s", out)
+	}
+}
+
+func TestFileErrorResponse(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gobal-web-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	writeFile(t, tmp+"/file", []byte("x"))
+	if err := os.Mkdir(tmp+"/locked", 0); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(tmp+"/locked", 0755)
+	writeFile(t, tmp+"/secret", []byte("x"))
+	if err := os.Chmod(tmp+"/secret", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	open := func(file string) error {
+		_, err := os.Open(file)
+		return err
+	}
+	tests := []struct {
+		name   string
+		err    error
+		status int
+	}{
+		{"missing", open(tmp + "/missing"), 404},
+		{"under a file", open(tmp + "/file/x"), 404},
+		{"permission", &os.PathError{Op: "open", Path: tmp + "/secret",
+			Err: os.ErrPermission}, 403},
+		{"anything else", errors.New("disk on fire"), 500},
+	}
+
+	// Root can read anything, so only try for real when we aren't.
+	if os.Geteuid() != 0 {
+		tests = append(tests, []struct {
+			name   string
+			err    error
+			status int
+		}{
+			{"unreadable", open(tmp + "/secret"), 403},
+			{"locked directory", open(tmp + "/locked/x"), 403},
+		}...)
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/", nil)
+		if resp := FileErrorResponse(req, test.err); resp.StatusCode !=
+			test.status {
+			t.Errorf("%s: got %d for %v; want %d", test.name, resp.StatusCode,
+				test.err, test.status)
+		}
+	}
+}